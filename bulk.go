@@ -0,0 +1,433 @@
+package flickgo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Uploads many files concurrently.  Every request goes through the client's
+// RateLimiter, so the workers share its budget with other calls made through
+// the client.
+type BulkUploader struct {
+	// Client to upload with, which must have write permission.
+	Client *Client
+
+	// Number of files uploaded at once.  Defaults to 4.
+	Workers int
+
+	// Number of attempts per file, including the first.  Defaults to 3.
+	// Only failures that show the photo was not stored, such as a refused
+	// connection or Flickr being unavailable, are retried; these retries
+	// come on top of those made by Client.Retry.  Failures that may have
+	// left the photo stored, such as a connection dropped while waiting for
+	// the response, are reported and not recorded in the journal; run again
+	// with SkipDuplicates set to upload the file only if it is missing.
+	MaxAttempts int
+
+	// Delay before retrying a file.  Defaults to 5 seconds.
+	RetryDelay time.Duration
+
+	// Path of a journal file recording finished uploads.  Files recorded in
+	// it are not uploaded again, so a run that was interrupted can be
+	// resumed by running it again with the same journal.  Files are
+	// identified by the path passed to Run.  Empty disables the journal.
+	JournalPath string
+
+	// Returns the metadata for the file at path.  Nil uploads every file
+	// with zero UploadParams.
+	Params func(path string) UploadParams
+
+	// Title of a photoset to add every uploaded photo to.  The set is
+	// created, with the first uploaded photo as its primary photo, if the
+	// user has no set with this title.  Empty leaves photos out of sets.
+	Photoset string
+
+	// Whether to skip files already on Flickr.  Each upload is tagged with
+	// the ChecksumTag of the file, and files whose tag is found by
+	// FindByMachineTag are not uploaded.  This catches duplicates the
+	// journal cannot, such as files uploaded by another run, but costs a
+	// search per file.
+	SkipDuplicates bool
+
+	// Optional callback reporting each finished file.
+	Done func(result BulkResult)
+}
+
+// Outcome of uploading one file with a BulkUploader.
+type BulkResult struct {
+	Path    string
+	PhotoID string
+
+	// Whether the journal showed the file as uploaded by an earlier run.
+	Resumed bool
+
+	// Whether the file was not uploaded because PhotoID has the same
+	// content; see BulkUploader.SkipDuplicates.
+	Duplicate bool
+
+	// Reason the upload, or adding the photo to the photoset, failed.
+	Err error
+}
+
+// Outcome of a BulkUploader run, with one result per file in the order the
+// files were given.
+type BulkReport struct {
+	Results []BulkResult
+}
+
+// Returns the IDs of the uploaded photos, by path.
+func (r *BulkReport) PhotoIDs() map[string]string {
+	m := make(map[string]string)
+	for _, res := range r.Results {
+		if res.PhotoID != "" {
+			m[res.Path] = res.PhotoID
+		}
+	}
+	return m
+}
+
+// Returns the results of the files that failed.
+func (r *BulkReport) Failed() []BulkResult {
+	var failed []BulkResult
+	for _, res := range r.Results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Entry of a BulkUploader journal, one JSON object per line.  A file has
+// one entry once uploaded, and another once added to the photoset.
+type journalEntry struct {
+	Path       string `json:"path"`
+	PhotoID    string `json:"photo_id"`
+	PhotosetID string `json:"photoset_id,omitempty"`
+}
+
+// Append-only record of finished uploads.
+type journal struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries map[string]journalEntry
+}
+
+// Opens the journal at path, creating it if it does not exist, and reads its
+// entries.
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, wrapErr("opening journal failed", err)
+	}
+	j := &journal{f: f, entries: make(map[string]journalEntry)}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// A run killed mid-write leaves a partial last line.
+			continue
+		}
+		j.entries[e.Path] = e
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, wrapErr("reading journal failed", err)
+	}
+	return j, nil
+}
+
+// Returns the entry recorded for path.
+func (j *journal) get(path string) (journalEntry, bool) {
+	if j == nil {
+		return journalEntry{}, false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.entries[path]
+	return e, ok
+}
+
+// Records e and flushes it to disk.
+func (j *journal) add(e journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return wrapErr("encoding journal entry failed", err)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return wrapErr("writing journal failed", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return wrapErr("writing journal failed", err)
+	}
+	j.entries[e.Path] = e
+	return nil
+}
+
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// Finds or creates the photoset photos are added to.
+type setAdder struct {
+	c     *Client
+	title string
+
+	mu sync.Mutex
+	id string
+}
+
+// Adds photoID to the set, creating the set with photoID as its primary
+// photo if needed.  Returns the set's ID.
+func (s *setAdder) add(ctx context.Context, photoID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id == "" {
+		id, err := findPhotoset(ctx, s.c, s.title)
+		if err != nil {
+			return "", err
+		}
+		if id == "" {
+			// The primary photo of a new set is already in it.
+			if s.id, err = createPhotoset(ctx, s.c, s.title, photoID); err != nil {
+				return "", err
+			}
+			return s.id, nil
+		}
+		s.id = id
+	}
+	return s.id, addToPhotoset(ctx, s.c, s.id, photoID)
+}
+
+// Returns the ID of the calling user's photoset with the given title, or ""
+// if there is none.
+func findPhotoset(ctx context.Context, c *Client, title string) (string, error) {
+	for page := 1; ; page++ {
+		r, err := c.PhotosetsGetListContext(ctx, PhotosetsGetListParams{Page: page, PerPage: 500})
+		if err != nil {
+			return "", err
+		}
+		for _, s := range r.Photosets {
+			if s.Title == title {
+				return s.ID, nil
+			}
+		}
+		if page >= r.Pages {
+			return "", nil
+		}
+	}
+}
+
+// Creates a photoset and returns its ID.
+func createPhotoset(ctx context.Context, c *Client, title string, primaryPhotoID string) (string, error) {
+	s, err := c.PhotosetsCreateContext(ctx, PhotosetsCreateParams{Title: title, PrimaryPhotoID: primaryPhotoID})
+	if err != nil {
+		return "", err
+	}
+	return s.ID, nil
+}
+
+// Adds a photo to a photoset.  Photos already in the set are left alone.
+func addToPhotoset(ctx context.Context, c *Client, setID string, photoID string) error {
+	err := c.PhotosetsAddPhotoContext(ctx, PhotosetsAddPhotoParams{PhotosetID: setID, PhotoID: photoID})
+	if errors.Is(err, &APIError{Code: ErrCodePhotoAlreadyInSet}) {
+		return nil
+	}
+	return err
+}
+
+// Uploads the files at paths and returns the outcome for each of them.  The
+// error is non-nil only if the journal cannot be used.
+func (u *BulkUploader) Run(paths []string) (*BulkReport, error) {
+	return u.RunContext(context.Background(), paths)
+}
+
+// Same as Run, but ctx controls cancellation.  Files not uploaded before ctx
+// is done are reported with ctx.Err(), and the journal keeps the finished
+// ones for the next run.
+func (u *BulkUploader) RunContext(ctx context.Context, paths []string) (*BulkReport, error) {
+	var j *journal
+	if u.JournalPath != "" {
+		var err error
+		if j, err = openJournal(u.JournalPath); err != nil {
+			return nil, err
+		}
+		defer j.close()
+	}
+	var sets *setAdder
+	if u.Photoset != "" {
+		sets = &setAdder{c: u.Client, title: u.Photoset}
+	}
+	workers := u.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+
+	report := &BulkReport{Results: make([]BulkResult, len(paths))}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				r := u.uploadFile(ctx, j, sets, paths[i])
+				report.Results[i] = r
+				if u.Done != nil {
+					u.Done(r)
+				}
+			}
+		}()
+	}
+	for i := range paths {
+		report.Results[i].Path = paths[i]
+		if ctx.Err() == nil {
+			select {
+			case indexes <- i:
+				continue
+			case <-ctx.Done():
+			}
+		}
+		report.Results[i].Err = ctx.Err()
+	}
+	close(indexes)
+	wg.Wait()
+	return report, nil
+}
+
+// Uploads the file at path unless the journal has it, and adds it to the
+// photoset.
+func (u *BulkUploader) uploadFile(ctx context.Context, j *journal, sets *setAdder,
+	path string) BulkResult {
+	r := BulkResult{Path: path}
+	e, ok := j.get(path)
+	if ok {
+		r.PhotoID, r.Resumed = e.PhotoID, true
+	} else {
+		r.PhotoID, r.Duplicate, r.Err = u.uploadNew(ctx, path)
+		if r.Err != nil {
+			return r
+		}
+		e = journalEntry{Path: path, PhotoID: r.PhotoID}
+		if err := j.add(e); err != nil {
+			r.Err = err
+			return r
+		}
+	}
+	if sets == nil || e.PhotosetID != "" {
+		return r
+	}
+	setID, err := sets.add(ctx, r.PhotoID)
+	if err != nil {
+		r.Err = wrapErr("adding to photoset failed", err)
+		return r
+	}
+	e.PhotosetID = setID
+	r.Err = j.add(e)
+	return r
+}
+
+// Uploads the file at path, unless SkipDuplicates is set and the file is
+// already on Flickr.  Returns the photo ID and whether the file was a
+// duplicate.
+func (u *BulkUploader) uploadNew(ctx context.Context, path string) (string, bool, error) {
+	var params UploadParams
+	if u.Params != nil {
+		params = u.Params(path)
+	}
+	if u.SkipDuplicates {
+		tag, err := fileChecksumTag(path)
+		if err != nil {
+			return "", false, err
+		}
+		id, err := u.Client.FindByMachineTagContext(ctx, tag)
+		if err != nil {
+			return "", false, wrapErr("searching for duplicates failed", err)
+		}
+		if id != "" {
+			return id, true, nil
+		}
+		params.Tags = append(params.Tags[:len(params.Tags):len(params.Tags)], tag)
+	}
+	id, err := u.uploadWithRetry(ctx, path, params)
+	return id, false, err
+}
+
+// Uploads the file at path, retrying failures that show the photo was not
+// stored.  An attempt whose response was lost may have stored the photo, and
+// Flickr only finds new photos by tag after a delay, so such failures are
+// never retried.
+func (u *BulkUploader) uploadWithRetry(ctx context.Context, path string,
+	params UploadParams) (string, error) {
+	attempts := u.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	delay := u.RetryDelay
+	if delay <= 0 {
+		delay = 5 * time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		id, err := u.upload(ctx, path, params)
+		if err == nil || attempt >= attempts || ctx.Err() != nil || !uploadRejected(err) {
+			return id, err
+		}
+		if u.Client.Logger != nil {
+			u.Client.Logger.Debugf("uploading %s: attempt %d of %d failed, retrying in %v: %v\n",
+				path, attempt, attempts, delay, err)
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Reports whether err shows that an upload was not stored by Flickr: the
+// connection to Flickr could not be made, or Flickr turned the request away
+// before processing it.
+func uploadRejected(err error) bool {
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "dial" {
+		return true
+	}
+	var h *HTTPError
+	if errors.As(err, &h) {
+		return h.StatusCode == http.StatusTooManyRequests ||
+			h.StatusCode == http.StatusServiceUnavailable
+	}
+	switch errorCode(err) {
+	case ErrCodeServiceUnavailable, ErrCodeWriteFailed:
+		return true
+	}
+	return false
+}
+
+// Uploads the file at path.
+func (u *BulkUploader) upload(ctx context.Context, path string, params UploadParams) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	file := UploadFile{Name: filepath.Base(path), Reader: f, Size: fi.Size()}
+	return u.Client.UploadSyncContext(ctx, file, params)
+}
@@ -0,0 +1,56 @@
+package flickgo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// Namespace and predicate of the machine tags added by ChecksumTag.
+const checksumTagPrefix = "checksum:sha256="
+
+// Returns a machine tag identifying the content read from r, of the form
+// "checksum:sha256=<hex digest>".  Tagging uploads with it lets
+// FindByMachineTag find a photo that was uploaded before.
+func ChecksumTag(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", wrapErr("hashing failed", err)
+	}
+	return checksumTagPrefix + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns the ChecksumTag of the file at path.
+func fileChecksumTag(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return ChecksumTag(f)
+}
+
+// Returns the ID of one of the calling user's photos tagged with the machine
+// tag, or "" if there is none.  Flickr indexes new photos for search with a
+// short delay, so a photo uploaded moments ago may not be found yet.
+func (c *Client) FindByMachineTag(tag string) (string, error) {
+	return c.FindByMachineTagContext(context.Background(), tag)
+}
+
+// Same as FindByMachineTag, but ctx controls cancellation of the call.
+func (c *Client) FindByMachineTagContext(ctx context.Context, tag string) (string, error) {
+	r, err := c.PhotosSearchContext(ctx, PhotosSearchParams{
+		UserID:      "me",
+		MachineTags: tag,
+		PerPage:     1,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(r.Photos) == 0 {
+		return "", nil
+	}
+	return r.Photos[0].ID, nil
+}
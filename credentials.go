@@ -0,0 +1,169 @@
+package flickgo
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// OAuth credentials for acting on behalf of a Flickr user.
+type Credentials struct {
+	// OAuth access token and token secret.
+	Token  string `json:"token"`
+	Secret string `json:"secret"`
+
+	// NSID of the user the token belongs to.
+	NSID string `json:"nsid,omitempty"`
+
+	// Permission level granted by the user: ReadPerm, WritePerm or
+	// DeletePerm.
+	Perms string `json:"perms,omitempty"`
+}
+
+// Returned by TokenStore implementations when no credentials are stored under
+// the requested key.
+var ErrNoCredentials = errors.New("no credentials stored")
+
+// Persistent storage for user credentials.  Keys are chosen by the caller,
+// typically the app's own user IDs.  Implementations must be safe for
+// concurrent use.
+type TokenStore interface {
+	// Returns the credentials stored under key, or ErrNoCredentials.
+	Get(key string) (Credentials, error)
+
+	// Stores creds under key, replacing any existing credentials.
+	Put(key string, creds Credentials) error
+
+	// Removes the credentials stored under key.  Deleting a missing key is
+	// not an error.
+	Delete(key string) error
+}
+
+// TokenStore that keeps credentials in memory.
+type MemoryTokenStore struct {
+	mu    sync.RWMutex
+	creds map[string]Credentials
+}
+
+// Creates an empty MemoryTokenStore.
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{creds: make(map[string]Credentials)}
+}
+
+func (s *MemoryTokenStore) Get(key string) (Credentials, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	creds, ok := s.creds[key]
+	if !ok {
+		return Credentials{}, ErrNoCredentials
+	}
+	return creds, nil
+}
+
+func (s *MemoryTokenStore) Put(key string, creds Credentials) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds[key] = creds
+	return nil
+}
+
+func (s *MemoryTokenStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.creds, key)
+	return nil
+}
+
+// TokenStore that keeps credentials in a JSON file.  The file is read on
+// every call and replaced atomically on every change, so several processes
+// may share it as long as they do not write concurrently.
+type FileTokenStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Creates a FileTokenStore backed by the file at path.  The file is created
+// on the first Put if it does not exist.
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{path: path}
+}
+
+func (s *FileTokenStore) load() (map[string]Credentials, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return make(map[string]Credentials), nil
+	}
+	if err != nil {
+		return nil, wrapErr("reading token file failed", err)
+	}
+	m := make(map[string]Credentials)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, wrapErr("parsing token file failed", err)
+	}
+	return m, nil
+}
+
+func (s *FileTokenStore) save(m map[string]Credentials) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return wrapErr("encoding tokens failed", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return wrapErr("creating token file failed", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return wrapErr("writing token file failed", err)
+	}
+	if err := f.Close(); err != nil {
+		return wrapErr("writing token file failed", err)
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return wrapErr("replacing token file failed", err)
+	}
+	return nil
+}
+
+func (s *FileTokenStore) Get(key string) (Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.load()
+	if err != nil {
+		return Credentials{}, err
+	}
+	creds, ok := m[key]
+	if !ok {
+		return Credentials{}, ErrNoCredentials
+	}
+	return creds, nil
+}
+
+func (s *FileTokenStore) Put(key string, creds Credentials) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	m[key] = creds
+	return s.save(m)
+}
+
+func (s *FileTokenStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := m[key]; !ok {
+		return nil
+	}
+	delete(m, key)
+	return s.save(m)
+}
@@ -0,0 +1,219 @@
+package flickgo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Error codes returned by Flickr.  Codes below 95 are specific to each method;
+// see the method's documentation at https://www.flickr.com/services/api/.
+const (
+	// Returned by most methods that take an ID, such as "Photo not found" or
+	// "User not found".
+	ErrCodeNotFound = 1
+
+	ErrCodeSSLRequired             = 95
+	ErrCodeInvalidSignature        = 96
+	ErrCodeMissingSignature        = 97
+	ErrCodeInvalidAuthToken        = 98
+	ErrCodeInsufficientPermissions = 99
+	ErrCodeInvalidAPIKey           = 100
+	ErrCodeServiceUnavailable      = 105
+	ErrCodeWriteFailed             = 106
+	ErrCodeFormatNotFound          = 111
+	ErrCodeMethodNotFound          = 112
+	ErrCodeBadURL                  = 116
+)
+
+// Error codes returned by the upload and replace endpoints.  See
+// https://www.flickr.com/services/api/upload.api.html.
+const (
+	ErrCodeNoPhoto             = 2
+	ErrCodeUploadFailed        = 3
+	ErrCodeFileSizeZero        = 4
+	ErrCodeFiletypeUnsupported = 5
+	ErrCodeUploadLimitExceeded = 6
+)
+
+// Returned by flickr.photosets.addPhoto for photos that are already in the
+// set.
+const ErrCodePhotoAlreadyInSet = 3
+
+// Reasons for Flickr rejecting an upload or replace, for use with errors.Is.
+// Each matches the *APIError with the corresponding code returned by the
+// upload and replace methods.
+var (
+	ErrNoPhoto             = errors.New("no photo specified")
+	ErrUploadFailed        = errors.New("general upload failure")
+	ErrFileSizeZero        = errors.New("filesize was zero")
+	ErrFiletypeUnsupported = errors.New("filetype was not recognised")
+	ErrUploadLimitExceeded = errors.New("user exceeded upload limit")
+)
+
+var uploadErrors = map[int]error{
+	ErrCodeNoPhoto:             ErrNoPhoto,
+	ErrCodeUploadFailed:        ErrUploadFailed,
+	ErrCodeFileSizeZero:        ErrFileSizeZero,
+	ErrCodeFiletypeUnsupported: ErrFiletypeUnsupported,
+	ErrCodeUploadLimitExceeded: ErrUploadLimitExceeded,
+}
+
+// Error reported by Flickr in response to an API call.
+type APIError struct {
+	// Flickr method that failed, e.g. "flickr.photos.search", or "upload"
+	// or "replace" for the upload endpoints.
+	Method string
+
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Method == "" {
+		return fmt.Sprintf("Flickr error code %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: Flickr error code %d: %s", e.Method, e.Code, e.Message)
+}
+
+// Reports whether target is an *APIError with the same code as e and, if
+// target has one, the same method.  This lets callers write
+//
+//	errors.Is(err, &flickgo.APIError{Code: flickgo.ErrCodeInvalidAPIKey})
+//
+// Errors from uploads also match the corresponding sentinel, such as
+// ErrUploadLimitExceeded.
+func (e *APIError) Is(target error) bool {
+	if e.Method == "upload" || e.Method == "replace" {
+		if err, ok := uploadErrors[e.Code]; ok && err == target {
+			return true
+		}
+	}
+	t, ok := target.(*APIError)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code && (t.Method == "" || t.Method == e.Method)
+}
+
+// Error for a response with a non-2xx HTTP status.  These come from Flickr's
+// front-end servers or from proxies, not from the API itself, so the body is
+// usually an HTML or plain text page rather than an API response.
+type HTTPError struct {
+	StatusCode int
+
+	// Status line, e.g. "502 Bad Gateway".
+	Status string
+
+	Header http.Header
+
+	// How long the server asked clients to wait before retrying, from the
+	// Retry-After header.  Zero if the header was absent.
+	RetryAfter time.Duration
+
+	// Start of the response body, truncated to a few hundred bytes.
+	Body string
+}
+
+func (e *HTTPError) Error() string {
+	if e.Body == "" {
+		return "Flickr returned HTTP " + e.Status
+	}
+	return fmt.Sprintf("Flickr returned HTTP %s: %s", e.Status, e.Body)
+}
+
+// Error for an asynchronous upload that Flickr did not turn into a photo.
+type TicketError struct {
+	TicketID string
+
+	// Whether Flickr did not recognise the ticket, rather than failing to
+	// process the upload.
+	Invalid bool
+}
+
+func (e *TicketError) Error() string {
+	if e.Invalid {
+		return "invalid upload ticket " + e.TicketID
+	}
+	return "processing upload ticket " + e.TicketID + " failed"
+}
+
+// Returns the code of the APIError in err's chain, or -1 if there is none.
+func errorCode(err error) int {
+	var e *APIError
+	if !errors.As(err, &e) {
+		return -1
+	}
+	return e.Code
+}
+
+// Codes meaning that something does not exist, for methods where they are
+// not just ErrCodeNotFound.  Flickr's messages are not part of the API, so
+// only codes are compared.
+var notFoundCodes = map[string][]int{
+	// Code 1 is "Too many tags in ALL query".
+	"flickr.photos.search": {2},
+	// Code 1 is "No title specified".
+	"flickr.photosets.create": {2},
+	// Photoset not found and photo not found.
+	"flickr.photosets.addPhoto":        {1, 2},
+	"flickr.photosets.editPhotos":      {1, 2},
+	"flickr.photosets.removePhoto":     {1, 2},
+	"flickr.photosets.removePhotos":    {1, 2},
+	"flickr.photosets.reorderPhotos":   {1, 2},
+	"flickr.photosets.setPrimaryPhoto": {1, 2},
+	// Upload codes are listed in uploadErrors.
+	"upload":  nil,
+	"replace": nil,
+}
+
+// Reports whether err says that the requested photo, user, set, etc. does not
+// exist.
+func IsNotFound(err error) bool {
+	var e *APIError
+	if !errors.As(err, &e) {
+		return false
+	}
+	codes, ok := notFoundCodes[e.Method]
+	if !ok {
+		return e.Code == ErrCodeNotFound
+	}
+	for _, c := range codes {
+		if e.Code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether err was caused by missing or invalid credentials, a bad
+// signature, or the user not granting enough permissions.
+func IsAuthError(err error) bool {
+	switch errorCode(err) {
+	case ErrCodeInvalidSignature, ErrCodeMissingSignature, ErrCodeInvalidAuthToken,
+		ErrCodeInsufficientPermissions, ErrCodeInvalidAPIKey:
+		return true
+	}
+	return false
+}
+
+// Reports whether err is a temporary failure on Flickr's side, so that the
+// same call may succeed if retried later.
+func IsRetryable(err error) bool {
+	var h *HTTPError
+	if errors.As(err, &h) {
+		switch h.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	switch errorCode(err) {
+	case ErrCodeServiceUnavailable, ErrCodeWriteFailed:
+		return true
+	}
+	return false
+}
@@ -3,17 +3,19 @@
 package flickgo
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
 	"regexp"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
 // Flickr API permission levels.  See
-// http://www.flickr.com/services/api/auth.spec.html.
+// https://www.flickr.com/services/api/auth.oauth.html.
 const (
 	ReadPerm   = "read"
 	WritePerm  = "write"
@@ -27,15 +29,33 @@ type Debugfer interface {
 	Debugf(format string, args ...interface{})
 }
 
-// Flickr client.
+// Flickr client.  A Client is safe for concurrent use; use WithUser to make
+// calls on behalf of a user.
 type Client struct {
-	// Auth token for acting on behalf of a user.
-	AuthToken string
-
 	// Logger to use.
 	// Hint: App engine's Context implements this interface.
 	Logger Debugfer
 
+	// Number of bytes at the start of each response body to log through
+	// Logger.  Zero, the default, disables logging response bodies, which
+	// can be hundreds of kilobytes for search results.
+	LogBodyLimit int
+
+	// Policy for retrying calls that fail with temporary errors.  Nil
+	// disables retries.  See DefaultRetryPolicy.
+	Retry *RetryPolicy
+
+	// Format of REST responses requested from Flickr: FormatXML (the default)
+	// or FormatJSON.  Both decode to identical values.
+	Format string
+
+	// Limits the rate of requests; nil means no limit.  New sets it to a
+	// limiter of its own; use SharedRateLimiter to share one between clients.
+	RateLimiter RateLimiter
+
+	// URLs to send requests to.  Empty fields use Flickr's own endpoints.
+	Endpoints Endpoints
+
 	// API key for your app.
 	apiKey string
 
@@ -45,12 +65,14 @@ type Client struct {
 	// Client to use for HTTP communication.
 	httpClient *http.Client
 
-	// Prevent exceeding the Flickr limit of 3600 requests per hour.
-	mu          sync.Mutex
-	lastRequest time.Time
-}
+	// Credentials of the user on whose behalf calls are made.  Empty for
+	// clients returned by New.
+	creds Credentials
 
-const requestPeriod = time.Second
+	// Requests made in the last hour.  Shared by all clients derived from
+	// the same New call.
+	quota *quotaCounter
+}
 
 // Creates a new Client object.  See
 // http://www.flickr.com/services/api/misc.api_keys.html for learning about API
@@ -58,57 +80,63 @@ const requestPeriod = time.Second
 // urlfetch.Client function; other apps can pass http.DefaultClient.
 func New(apiKey string, secret string, httpClient *http.Client) *Client {
 	return &Client{
-		apiKey:     apiKey,
-		secret:     secret,
-		httpClient: httpClient,
+		apiKey:      apiKey,
+		secret:      secret,
+		httpClient:  httpClient,
+		RateLimiter: NewDefaultRateLimiter(),
+		quota:       &quotaCounter{},
 	}
 }
 
-// Returns the URL for requesting authorisation to access the user's Flickr
-// account.  List of possible permissions are defined at
-// http://www.flickr.com/services/api/auth.spec.html.  You can also use one of
-// the following constants:
-//     ReadPerm
-//     WritePerm
-//     DeletePerm
-func (c *Client) AuthURL(perms string) string {
-	args := map[string]string{}
-	args["perms"] = perms
-	return signedURL(c.secret, c.apiKey, "auth", args)
+// Returns a copy of c that makes calls on behalf of the user identified by
+// creds.  The returned client shares c's HTTP client, logger, retry policy
+// and rate limit, so it is cheap enough to create for every call.
+func (c *Client) WithUser(creds Credentials) *Client {
+	return &Client{
+		Logger:       c.Logger,
+		LogBodyLimit: c.LogBodyLimit,
+		Retry:        c.Retry,
+		Format:       c.Format,
+		RateLimiter:  c.RateLimiter,
+		Endpoints:    c.Endpoints,
+		apiKey:       c.apiKey,
+		secret:       c.secret,
+		httpClient:   c.httpClient,
+		creds:        creds,
+		quota:        c.quota,
+	}
 }
 
-// Returns the signed URL for Flickr's flickr.auth.getToken request.
-func getTokenURL(c *Client, frob string) string {
-	return makeURL(c, "flickr.auth.getToken", map[string]string{"frob": frob}, true)
+// Returns the credentials c uses for calls; see WithUser.
+func (c *Client) Credentials() Credentials {
+	return c.creds
 }
 
+// The <err> element of a failed Flickr response.
 type flickrError struct {
-	Code string `xml:"code,attr"`
+	Code int    `xml:"code,attr"`
 	Msg  string `xml:"msg,attr"`
 }
 
-func (e *flickrError) Err() error {
-	return fmt.Errorf("Flickr error code %s: %s", e.Code, e.Msg)
+// Returns the error reported by Flickr for a call to method.
+func (e *flickrError) Err(method string) error {
+	return &APIError{Method: method, Code: e.Code, Message: e.Msg}
 }
 
-// Exchanges a temporary frob for a token that's valid forever.
-// See http://www.flickr.com/services/api/auth.howto.web.html.
-func (c *Client) GetToken(frob string) (string, *User, error) {
-	r := struct {
-		Stat string      `xml:"stat,attr"`
-		Err  flickrError `xml:"err"`
-		Auth struct {
-			Token string `xml:"token"`
-			User  User   `xml:"user"`
-		} `xml:"auth"`
-	}{}
-	if err := flickrGet(c, getTokenURL(c, frob), &r); err != nil {
-		return "", nil, err
-	}
-	if r.Stat != "ok" {
-		return "", nil, r.Err.Err()
-	}
-	return r.Auth.Token, &r.Auth.User, nil
+// Status of a Flickr response.  Embedded in every response struct so that
+// flickrGet and flickrPost can detect failed calls.
+type apiStatus struct {
+	Stat string      `xml:"stat,attr"`
+	Err  flickrError `xml:"err"`
+}
+
+func (s *apiStatus) status() *apiStatus {
+	return s
+}
+
+// Implemented by response structs embedding apiStatus.
+type apiResponse interface {
+	status() *apiStatus
 }
 
 // Returns URL for Flickr photo search.
@@ -137,11 +165,11 @@ type PhotosSearchParams struct {
 	// Maximum upload date. Photos with an upload date less than or equal to this value will be returned. The date can be in the form of a unix timestamp or mysql datetime.
 	MaxUploadDate time.Time `mapper:"max_upload_date"`
 
-	// Minimum taken date. Photos with an taken date greater than or equal to this value will be returned. The date can be in the form of a mysql datetime or unix timestamp.
-	MinTakenDate time.Time `mapper:"min_taken_date"`
+	// Minimum taken date. Photos with an taken date greater than or equal to this value will be returned. Sent as a mysql datetime in UTC, which unlike a unix timestamp can be before 1970.
+	MinTakenDate time.Time `mapper:"min_taken_date,datetime"`
 
-	// Maximum taken date. Photos with an taken date less than or equal to this value will be returned. The date can be in the form of a mysql datetime or unix timestamp.
-	MaxTakenDate time.Time `mapper:"max_taken_date"`
+	// Maximum taken date. Photos with an taken date less than or equal to this value will be returned. Sent as a mysql datetime in UTC.
+	MaxTakenDate time.Time `mapper:"max_taken_date,datetime"`
 
 	// The license id for photos (for possible values see the flickr.photos.licenses.getInfo method). Multiple licenses may be comma-separated.
 	License string `mapper:"license"`
@@ -297,17 +325,18 @@ type PhotosSearchParams struct {
 // Searches for photos.  args contains search parameters as described in
 // http://www.flickr.com/services/api/flickr.photos.search.html.
 func (c *Client) PhotosSearch(params PhotosSearchParams) (*SearchResponse, error) {
+	return c.PhotosSearchContext(context.Background(), params)
+}
+
+// Same as PhotosSearch, but ctx controls cancellation of the call.
+func (c *Client) PhotosSearchContext(ctx context.Context, params PhotosSearchParams) (*SearchResponse, error) {
 	r := struct {
-		Stat   string         `xml:"stat,attr"`
-		Err    flickrError    `xml:"err"`
+		apiStatus
 		Photos SearchResponse `xml:"photos"`
 	}{}
-	if err := flickrGet(c, makeURL(c, "flickr.photos.search", StructToMap(params), true), &r); err != nil {
+	if err := flickrCall(ctx, c, "flickr.photos.search", StructToMap(params), &r); err != nil {
 		return nil, err
 	}
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
 
 	for i, ph := range r.Photos.Photos {
 		h, hErr := strconv.ParseFloat(ph.HeightT, 64)
@@ -335,121 +364,244 @@ type ContactsGetPublicListParams struct {
 // Get the contact list for a user.  args contains search parameters as described in
 // http://www.flickr.com/services/api/flickr.contacts.getPublicList.html.
 func (c *Client) ContactsGetPublicList(params ContactsGetPublicListParams) (*ContactsGetPublicListResponse, error) {
+	return c.ContactsGetPublicListContext(context.Background(), params)
+}
+
+// Same as ContactsGetPublicList, but ctx controls cancellation of the call.
+func (c *Client) ContactsGetPublicListContext(ctx context.Context, params ContactsGetPublicListParams) (*ContactsGetPublicListResponse, error) {
 	r := struct {
-		Stat     string                        `xml:"stat,attr"`
-		Err      flickrError                   `xml:"err"`
+		apiStatus
 		Contacts ContactsGetPublicListResponse `xml:"contacts"`
 	}{}
-	if err := flickrGet(c, makeURL(c, "flickr.contacts.getPublicList", StructToMap(params), true), &r); err != nil {
+	if err := flickrCall(ctx, c, "flickr.contacts.getPublicList", StructToMap(params), &r); err != nil {
 		return nil, err
 	}
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
 	return &r.Contacts, nil
 }
 
-// // Initiates an asynchronous photo upload and returns the ticket ID.  See
-// // http://www.flickr.com/services/api/upload.async.html for details.
-// func (c *Client) Upload(name string, photo []byte,
-// 	args map[string]string) (ticketID string, err error) {
-// 	req, uErr := uploadRequest(c, name, photo, args)
-// 	if uErr != nil {
-// 		return "", wrapErr("request creation failed", uErr)
-// 	}
-
-// 	resp := struct {
-// 		Stat     string      `xml:"stat,attr"`
-// 		Err      flickrError `xml:"err"`
-// 		TicketID string      `xml:"ticketid"`
-// 	}{}
-// 	if err := flickrPost(c, req, &resp); err != nil {
-// 		return "", wrapErr("uploading failed", err)
-// 	}
-// 	if resp.Stat != "ok" {
-// 		return "", resp.Err.Err()
-// 	}
-// 	return resp.TicketID, nil
-// }
-
-// // Returns URL for flickr.photos.upload.checkTickets request.
-// func checkTicketsURL(c *Client, tickets []string) string {
-// 	args := make(map[string]string)
-// 	args["tickets"] = strings.Join(tickets, ",")
-// 	return makeURL(c, "flickr.photos.upload.checkTickets", args, false)
-// }
-
-// // Asynchronous photo upload status response.
-// type TicketStatus struct {
-// 	ID       string `xml:"id,attr"`
-// 	Complete string `xml:"complete,attr"`
-// 	Invalid  string `xml:"invalid,attr"`
-// 	PhotoID  string `xml:"photoid,attr"`
-// }
-
-// // Checks the status of async upload tickets (returned by Upload method, for
-// // example).  Interface for
-// // http://www.flickr.com/services/api/flickr.photos.upload.checkTickets.html
-// // API method.
-// func (c *Client) CheckTickets(tickets []string) (statuses []TicketStatus, err error) {
-// 	r := struct {
-// 		Stat    string         `xml:"stat,attr"`
-// 		Err     flickrError    `xml:"err"`
-// 		Tickets []TicketStatus `xml:"uploader>ticket"`
-// 	}{}
-// 	if err := flickrGet(c, checkTicketsURL(c, tickets), &r); err != nil {
-// 		return nil, err
-// 	}
-// 	if r.Stat != "ok" {
-// 		return nil, r.Err.Err()
-// 	}
-// 	return r.Tickets, nil
-// }
-
-// // Returns URL for flickr.photosets.getList request.
-// func getPhotoSetsURL(c *Client, userID string) string {
-// 	args := make(map[string]string)
-// 	args["user_id"] = userID
-// 	return makeURL(c, "flickr.photosets.getList", args, true)
-// }
-
-// // Returns the list of photo sets of the specified user.
-// func (c *Client) GetSets(userID string) ([]PhotoSet, error) {
-// 	r := struct {
-// 		Stat string      `xml:"stat,attr"`
-// 		Err  flickrError `xml:"err"`
-// 		Sets []PhotoSet  `xml:"photosets>photoset"`
-// 	}{}
-// 	if err := flickrGet(c, getPhotoSetsURL(c, userID), &r); err != nil {
-// 		return nil, err
-// 	}
-// 	if r.Stat != "ok" {
-// 		return nil, r.Err.Err()
-// 	}
-// 	return r.Sets, nil
-// }
-
-// func addToSetURL(c *Client, photoID, setID string) string {
-// 	args := make(map[string]string)
-// 	args["photo_id"] = photoID
-// 	args["photoset_id"] = setID
-// 	return makeURL(c, "flickr.photosets.addPhoto", args, true)
-// }
-
-// // Adds a photo to a photoset.
-// func (c *Client) AddPhotoToSet(photoID, setID string) error {
-// 	r := struct {
-// 		Stat string      `xml:"stat,attr"`
-// 		Err  flickrError `xml:"err"`
-// 	}{}
-// 	if err := flickrGet(c, addToSetURL(c, photoID, setID), &r); err != nil {
-// 		return err
-// 	}
-// 	if r.Stat != "ok" {
-// 		return r.Err.Err()
-// 	}
-// 	return nil
-// }
+// Initiates an asynchronous photo upload and returns the ticket ID.  See
+// http://www.flickr.com/services/api/upload.async.html for details.
+func (c *Client) Upload(name string, photo []byte,
+	params UploadParams) (ticketID string, err error) {
+	return c.UploadContext(context.Background(), name, photo, params)
+}
+
+// Same as Upload, but ctx controls cancellation of the call.
+func (c *Client) UploadContext(ctx context.Context, name string, photo []byte,
+	params UploadParams) (ticketID string, err error) {
+	return c.UploadStreamContext(ctx, bytesFile(name, photo), params)
+}
+
+// Same as Upload, but streams the file from file.Reader instead of holding it
+// in memory.
+func (c *Client) UploadStream(file UploadFile, params UploadParams) (ticketID string, err error) {
+	return c.UploadStreamContext(context.Background(), file, params)
+}
+
+// Same as UploadStream, but ctx controls cancellation of the call.
+func (c *Client) UploadStreamContext(ctx context.Context, file UploadFile,
+	params UploadParams) (ticketID string, err error) {
+	args, pErr := params.args()
+	if pErr != nil {
+		return "", wrapErr("invalid upload parameters", pErr)
+	}
+	resp := struct {
+		apiStatus
+		TicketID string `xml:"ticketid"`
+	}{}
+	if err := postUpload(ctx, c, "upload", c.uploadURL(), file, args, true, &resp); err != nil {
+		return "", err
+	}
+	return resp.TicketID, nil
+}
+
+// Uploads a photo and waits for Flickr to process it, returning the ID of the
+// new photo.  See https://www.flickr.com/services/api/upload.api.html.
+func (c *Client) UploadSync(file UploadFile, params UploadParams) (photoID string, err error) {
+	return c.UploadSyncContext(context.Background(), file, params)
+}
+
+// Same as UploadSync, but ctx controls cancellation of the call.
+func (c *Client) UploadSyncContext(ctx context.Context, file UploadFile,
+	params UploadParams) (photoID string, err error) {
+	args, pErr := params.args()
+	if pErr != nil {
+		return "", wrapErr("invalid upload parameters", pErr)
+	}
+	resp := struct {
+		apiStatus
+		PhotoID string `xml:"photoid"`
+	}{}
+	if err := postUpload(ctx, c, "upload", c.uploadURL(), file, args, false, &resp); err != nil {
+		return "", err
+	}
+	return resp.PhotoID, nil
+}
+
+// Photo whose file was replaced by Replace.
+type ReplacedPhoto struct {
+	ID             string `xml:",chardata"`
+	Secret         string `xml:"secret,attr"`
+	OriginalSecret string `xml:"originalsecret,attr"`
+}
+
+// Replaces the file of an existing photo, keeping its metadata, comments and
+// favourites, and waits for Flickr to process the new file.  See
+// https://www.flickr.com/services/api/replace.api.html.
+func (c *Client) Replace(photoID string, file UploadFile) (*ReplacedPhoto, error) {
+	return c.ReplaceContext(context.Background(), photoID, file)
+}
+
+// Same as Replace, but ctx controls cancellation of the call.
+func (c *Client) ReplaceContext(ctx context.Context, photoID string, file UploadFile) (*ReplacedPhoto, error) {
+	resp := struct {
+		apiStatus
+		Photo ReplacedPhoto `xml:"photoid"`
+	}{}
+	args := map[string]string{"photo_id": photoID}
+	if err := postUpload(ctx, c, "replace", c.replaceURL(), file, args, false, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Photo, nil
+}
+
+// Same as Replace, but returns a ticket ID for CheckTickets and
+// WaitForTickets without waiting for Flickr to process the file.
+func (c *Client) ReplaceAsync(photoID string, file UploadFile) (ticketID string, err error) {
+	return c.ReplaceAsyncContext(context.Background(), photoID, file)
+}
+
+// Same as ReplaceAsync, but ctx controls cancellation of the call.
+func (c *Client) ReplaceAsyncContext(ctx context.Context, photoID string, file UploadFile) (ticketID string, err error) {
+	resp := struct {
+		apiStatus
+		TicketID string `xml:"ticketid"`
+	}{}
+	args := map[string]string{"photo_id": photoID}
+	if err := postUpload(ctx, c, "replace", c.replaceURL(), file, args, true, &resp); err != nil {
+		return "", err
+	}
+	return resp.TicketID, nil
+}
+
+// Returns URL for flickr.photos.upload.checkTickets request.
+func checkTicketsURL(c *Client, tickets []string) string {
+	args := make(map[string]string)
+	args["tickets"] = strings.Join(tickets, ",")
+	return makeURL(c, "flickr.photos.upload.checkTickets", args, false)
+}
+
+// Asynchronous photo upload status response.
+type TicketStatus struct {
+	ID string `xml:"id,attr"`
+
+	// "0" while the upload is being processed, "1" once it is complete and
+	// "2" if processing failed.
+	Complete string `xml:"complete,attr"`
+
+	// "1" if Flickr does not know the ticket.
+	Invalid string `xml:"invalid,attr"`
+
+	PhotoID string `xml:"photoid,attr"`
+}
+
+// Checks the status of async upload tickets (returned by Upload method, for
+// example).  Interface for
+// http://www.flickr.com/services/api/flickr.photos.upload.checkTickets.html
+// API method.
+func (c *Client) CheckTickets(tickets []string) (statuses []TicketStatus, err error) {
+	return c.CheckTicketsContext(context.Background(), tickets)
+}
+
+// Same as CheckTickets, but ctx controls cancellation of the call.
+func (c *Client) CheckTicketsContext(ctx context.Context, tickets []string) (statuses []TicketStatus, err error) {
+	r := struct {
+		apiStatus
+		Tickets []TicketStatus `xml:"uploader>ticket"`
+	}{}
+	if err := flickrGet(ctx, c, "flickr.photos.upload.checkTickets", func() string {
+		return checkTicketsURL(c, tickets)
+	}, &r); err != nil {
+		return nil, err
+	}
+	return r.Tickets, nil
+}
+
+// Delays between polls in WaitForTickets: the first delay, doubled after
+// every poll up to the maximum.  Tests replace these.
+var (
+	ticketPollDelay    = time.Second
+	ticketPollMaxDelay = 30 * time.Second
+)
+
+// Polls flickr.photos.upload.checkTickets until every ticket has been
+// processed, and returns the ID of each uploaded photo in the order of
+// tickets.  The photo ID of a ticket that failed or was not recognised is
+// empty, and the returned error joins a *TicketError for each such ticket.
+func (c *Client) WaitForTickets(tickets []string) (photoIDs []string, err error) {
+	return c.WaitForTicketsContext(context.Background(), tickets)
+}
+
+// Same as WaitForTickets, but ctx controls cancellation of the polling.
+func (c *Client) WaitForTicketsContext(ctx context.Context, tickets []string) (photoIDs []string, err error) {
+	photoIDs = make([]string, len(tickets))
+	index := make(map[string][]int)
+	pending := make([]string, 0, len(tickets))
+	for i, t := range tickets {
+		if _, ok := index[t]; !ok {
+			pending = append(pending, t)
+		}
+		index[t] = append(index[t], i)
+	}
+	var errs []error
+	delay := ticketPollDelay
+	for len(pending) > 0 {
+		statuses, err := c.CheckTicketsContext(ctx, pending)
+		if err != nil {
+			return nil, err
+		}
+		done := make(map[string]bool)
+		for _, s := range statuses {
+			if _, ok := index[s.ID]; !ok || done[s.ID] {
+				continue
+			}
+			switch {
+			case s.Invalid == "1":
+				errs = append(errs, &TicketError{TicketID: s.ID, Invalid: true})
+			case s.Complete == "1":
+				for _, i := range index[s.ID] {
+					photoIDs[i] = s.PhotoID
+				}
+			case s.Complete == "2":
+				errs = append(errs, &TicketError{TicketID: s.ID})
+			default:
+				continue
+			}
+			done[s.ID] = true
+		}
+		still := pending[:0]
+		for _, t := range pending {
+			if !done[t] {
+				still = append(still, t)
+			}
+		}
+		pending = still
+		if len(pending) == 0 {
+			break
+		}
+		if c.Logger != nil {
+			c.Logger.Debugf("%d upload tickets pending, checking again in %v\n",
+				len(pending), delay)
+		}
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+		if delay *= 2; delay > ticketPollMaxDelay {
+			delay = ticketPollMaxDelay
+		}
+	}
+	return photoIDs, errors.Join(errs...)
+}
 
 func getLocationURL(c *Client, args map[string]string) string {
 	argsCopy := clone(args)
@@ -458,19 +610,21 @@ func getLocationURL(c *Client, args map[string]string) string {
 
 // Implements https://www.flickr.com/services/api/flickr.photos.geo.getLocation.html
 func (c *Client) GetLocation(args map[string]string) (*LocationResponse, error) {
+	return c.GetLocationContext(context.Background(), args)
+}
+
+// Same as GetLocation, but ctx controls cancellation of the call.
+func (c *Client) GetLocationContext(ctx context.Context, args map[string]string) (*LocationResponse, error) {
 	r := struct {
-		Stat     string           `xml:"stat,attr"`
-		Err      flickrError      `xml:"err"`
+		apiStatus
 		Location LocationResponse `xml:"photo"`
 	}{}
-	if err := flickrGet(c, getLocationURL(c, args), &r); err != nil {
+	if err := flickrGet(ctx, c, "flickr.photos.geo.getLocation", func() string {
+		return getLocationURL(c, args)
+	}, &r); err != nil {
 		return nil, err
 	}
 
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
-
 	return &r.Location, nil
 }
 
@@ -480,19 +634,19 @@ type PeopleGetInfoParams struct {
 
 // Implements https://www.flickr.com/services/api/flickr.people.getInfo.html
 func (c *Client) PeopleGetInfo(params PeopleGetInfoParams) (*PersonResponse, error) {
+	return c.PeopleGetInfoContext(context.Background(), params)
+}
+
+// Same as PeopleGetInfo, but ctx controls cancellation of the call.
+func (c *Client) PeopleGetInfoContext(ctx context.Context, params PeopleGetInfoParams) (*PersonResponse, error) {
 	r := struct {
-		Stat   string         `xml:"stat,attr"`
-		Err    flickrError    `xml:"err"`
+		apiStatus
 		Person PersonResponse `xml:"person"`
 	}{}
-	if err := flickrGet(c, makeURL(c, "flickr.people.getInfo", StructToMap(params), true), &r); err != nil {
+	if err := flickrCall(ctx, c, "flickr.people.getInfo", StructToMap(params), &r); err != nil {
 		return nil, err
 	}
 
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
-
 	return &r.Person, nil
 }
 
@@ -503,17 +657,18 @@ type PhotosGetInfoParams struct {
 
 // Implements https://www.flickr.com/services/api/flickr.photos.getInfo.html
 func (c *Client) PhotosGetInfo(params PhotosGetInfoParams) (*PhotoInfoResponse, error) {
+	return c.PhotosGetInfoContext(context.Background(), params)
+}
+
+// Same as PhotosGetInfo, but ctx controls cancellation of the call.
+func (c *Client) PhotosGetInfoContext(ctx context.Context, params PhotosGetInfoParams) (*PhotoInfoResponse, error) {
 	r := struct {
-		Stat string      `xml:"stat,attr"`
-		Err  flickrError `xml:"err"`
+		apiStatus
 		PhotoInfoResponse
 	}{}
-	if err := flickrGet(c, makeURL(c, "flickr.photos.getInfo", StructToMap(params), true), &r); err != nil {
+	if err := flickrCall(ctx, c, "flickr.photos.getInfo", StructToMap(params), &r); err != nil {
 		return nil, err
 	}
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
 
 	return &r.PhotoInfoResponse, nil
 }
@@ -526,17 +681,18 @@ type PhotosGetFavoritesParams struct {
 
 // Implements https://www.flickr.com/services/api/flickr.photos.getFavorites.html
 func (c *Client) PhotosGetFavorites(params PhotosGetFavoritesParams) (*PhotoFavoritesResponse, error) {
+	return c.PhotosGetFavoritesContext(context.Background(), params)
+}
+
+// Same as PhotosGetFavorites, but ctx controls cancellation of the call.
+func (c *Client) PhotosGetFavoritesContext(ctx context.Context, params PhotosGetFavoritesParams) (*PhotoFavoritesResponse, error) {
 	r := struct {
-		Stat  string                 `xml:"stat,attr"`
-		Err   flickrError            `xml:"err"`
+		apiStatus
 		Faves PhotoFavoritesResponse `xml:"photo"`
 	}{}
-	if err := flickrGet(c, makeURL(c, "flickr.photos.getFavorites", StructToMap(params), true), &r); err != nil {
+	if err := flickrCall(ctx, c, "flickr.photos.getFavorites", StructToMap(params), &r); err != nil {
 		return nil, err
 	}
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
 
 	return &r.Faves, nil
 }
@@ -548,22 +704,25 @@ func pushSubscribeURL(c *Client, args map[string]string) string {
 
 // Implements https://api.flickr.com/services/rest/?method=flickr.push.subscribe
 func (c *Client) PushSubscribe(args map[string]string) error {
+	return c.PushSubscribeContext(context.Background(), args)
+}
+
+// Same as PushSubscribe, but ctx controls cancellation of the call.
+func (c *Client) PushSubscribeContext(ctx context.Context, args map[string]string) error {
 	r := struct {
-		Stat string      `xml:"stat,attr"`
-		Err  flickrError `xml:"err"`
+		apiStatus
 	}{}
-	if err := flickrGet(c, pushSubscribeURL(c, args), &r); err != nil {
-		return err
-	}
-	if r.Stat != "ok" {
-		return r.Err.Err()
-	}
-
-	return nil
+	return flickrGet(ctx, c, "flickr.push.subscribe", func() string {
+		return pushSubscribeURL(c, args)
+	}, &r)
 }
 
 var mapperTagRE = regexp.MustCompile(`\bmapper:"([^"]*)`)
 
+// Layout of MySQL datetimes, which fields tagged with the "datetime" mapper
+// option are sent as.
+const mysqlDatetime = "2006-01-02 15:04:05"
+
 func StructToMap(v interface{}) map[string]string {
 	r := make(map[string]string)
 	val := reflect.ValueOf(v)
@@ -580,7 +739,17 @@ func StructToMap(v interface{}) map[string]string {
 		if field.Anonymous || !val.CanInterface() {
 			continue
 		}
-		switch field.Type.Kind() {
+		ft := field.Type
+		// Pointers are set if not nil, even when pointing to a zero value.
+		isPtr := ft.Kind() == reflect.Ptr
+		if isPtr {
+			if val.IsNil() {
+				continue
+			}
+			val = val.Elem()
+			ft = ft.Elem()
+		}
+		switch ft.Kind() {
 		case reflect.Int:
 		case reflect.Int8:
 		case reflect.Int16:
@@ -594,25 +763,33 @@ func StructToMap(v interface{}) map[string]string {
 		case reflect.Float32:
 		case reflect.Float64:
 		case reflect.String:
+		case reflect.Bool:
 		default:
-			switch field.Type {
+			switch ft {
 			case reflect.TypeOf(time.Time{}):
 			default:
 				continue
 			}
 		}
-		z := reflect.Zero(field.Type)
-		if reflect.DeepEqual(val.Interface(), z.Interface()) {
+		z := reflect.Zero(ft)
+		if !isPtr && reflect.DeepEqual(val.Interface(), z.Interface()) {
 			continue
 		}
-		name := field.Name
+		name, opts := field.Name, ""
 		if m := mapperTagRE.FindStringSubmatch(string(t.Field(i).Tag)); len(m) == 2 {
-			name = m[1]
+			name, opts, _ = strings.Cut(m[1], ",")
 		}
 		var str string
-		switch field.Type {
-		case reflect.TypeOf(time.Time{}):
-			str = fmt.Sprintf("%d", val.Interface().(time.Time).UnixNano()/1e9)
+		switch {
+		case ft == reflect.TypeOf(time.Time{}) && opts == "datetime":
+			str = val.Interface().(time.Time).UTC().Format(mysqlDatetime)
+		case ft == reflect.TypeOf(time.Time{}):
+			str = fmt.Sprintf("%d", val.Interface().(time.Time).Unix())
+		case ft.Kind() == reflect.Bool:
+			str = "0"
+			if val.Bool() {
+				str = "1"
+			}
 		default:
 			str = fmt.Sprintf("%v", val.Interface())
 		}
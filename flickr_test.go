@@ -2,17 +2,30 @@ package flickgo
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -48,42 +61,80 @@ func assertValuesEq(t *testing.T, id string, expected url.Values, actual url.Val
 	}
 }
 
-//-----------------------
+// -----------------------
 // Tests for request.go
-//
-func write(h hash.Hash, s string) {
-	h.Write([]byte(s))
+func TestOAuthEscape(t *testing.T) {
+	assertEq(t, "unreserved", "Az09-._~", oauthEscape("Az09-._~"))
+	assertEq(t, "space", "a%20b", oauthEscape("a b"))
+	assertEq(t, "reserved", "%21%2A%27%28%29%2B%2C%2F%3A%3D%26", oauthEscape("!*'()+,/:=&"))
+	assertEq(t, "utf8", "%E2%98%83", oauthEscape("\u2603"))
 }
 
-func TestSignedURL(t *testing.T) {
-	m := md5.New()
-	write(m, secret)
-	write(m, "123"+"98765")
-	write(m, "abc"+"abc def")
-	write(m, "api_key"+"apap983 key")
-	write(m, "xyz"+"xyz")
-	sig := fmt.Sprintf("%x", m.Sum(nil))
-
+func TestOAuthSign(t *testing.T) {
+	// Example from https://developer.twitter.com/en/docs/authentication/oauth-1-0a/creating-a-signature.
 	args := map[string]string{
-		"abc": "abc def",
-		"xyz": "xyz",
-		"123": "98765",
-	}
-	qry := make(url.Values)
-	qry.Add("abc", "abc def")
-	qry.Add("xyz", "xyz")
-	qry.Add("123", "98765")
-	qry.Add("api_key", "apap983 key")
-	qry.Add("api_sig", sig)
-
-	expected, _ := url.Parse("https://api.flickr.com/services/srv/?" + qry.Encode())
-	actual, err := url.Parse(signedURL(secret, "apap983 key", "srv", args))
-	assertOK(t, "urlParse", err)
-	assertEq(t, "urlScheme", expected.Scheme, actual.Scheme)
-	assertEq(t, "urlHost", expected.Host, actual.Host)
-	assertEq(t, "urlPath", expected.Path, actual.Path)
-	assertEq(t, "urlFragment", expected.Fragment, actual.Fragment)
-	assertValuesEq(t, "urlQuery", expected.Query(), actual.Query())
+		"status":                 "Hello Ladies + Gentlemen, a signed OAuth request!",
+		"include_entities":       "true",
+		"oauth_consumer_key":     "xvz1evFS4wEEPTGEFPHBog",
+		"oauth_nonce":            "kYjzVBB8Y0ZFabxSWbWovY3uYSQ2pTgmZeNu2VS4cg",
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        "1318622958",
+		"oauth_token":            "370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb",
+		"oauth_version":          "1.0",
+	}
+	sig := oauthSign("kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw",
+		"LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE", "post",
+		"https://api.twitter.com/1.1/statuses/update.json", args)
+	assertEq(t, "signature", "hCtSmYh+iHYCEqBWrE7C7hYmtUk=", sig)
+}
+
+func TestMakeURL(t *testing.T) {
+	defer func(nonce func() string, now func() time.Time) {
+		oauthNonce, oauthTime = nonce, now
+	}(oauthNonce, oauthTime)
+	oauthNonce = func() string { return "nonce" }
+	oauthTime = func() time.Time { return time.Unix(1305586162, 0) }
+	c := New(apiKey, secret, nil).WithUser(Credentials{
+		Token:  "72157626737672178-022bbd2f4c2f3432",
+		Secret: "fccb68c4e6103197",
+	})
+
+	u, uErr := url.Parse(makeURL(c, "flickr.test.login", map[string]string{"a": "b c"}, true))
+	assertOK(t, "parseURL", uErr)
+	a := u.Query()
+	expected := map[string]string{
+		"a":                      "b c",
+		"method":                 "flickr.test.login",
+		"api_key":                apiKey,
+		"oauth_consumer_key":     apiKey,
+		"oauth_nonce":            "nonce",
+		"oauth_timestamp":        "1305586162",
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_version":          "1.0",
+		"oauth_token":            c.Credentials().Token,
+	}
+	for k, v := range expected {
+		assertEq(t, k, v, a.Get(k))
+	}
+	assertEq(t, "len", len(expected)+1, len(a))
+
+	m := hmac.New(sha1.New, []byte(secret+"&"+c.Credentials().Secret))
+	write(m, "GET&https%3A%2F%2Fapi.flickr.com%2Fservices%2Frest%2F&"+
+		"a%3Db%2520c%26api_key%3D"+apiKey+"%26method%3Dflickr.test.login%26"+
+		"oauth_consumer_key%3D"+apiKey+"%26oauth_nonce%3Dnonce%26"+
+		"oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1305586162%26"+
+		"oauth_token%3D72157626737672178-022bbd2f4c2f3432%26oauth_version%3D1.0")
+	assertEq(t, "oauth_signature",
+		base64.StdEncoding.EncodeToString(m.Sum(nil)), a.Get("oauth_signature"))
+
+	u, uErr = url.Parse(makeURL(c, "flickr.test.echo", map[string]string{}, false))
+	assertOK(t, "parseURL unauthenticated", uErr)
+	assertEq(t, "unsigned", "", u.Query().Get("oauth_signature"))
+	assertEq(t, "unsigned api_key", apiKey, u.Query().Get("api_key"))
+}
+
+func write(h hash.Hash, s string) {
+	h.Write([]byte(s))
 }
 
 type fakeBody struct {
@@ -137,9 +188,9 @@ func TestFetchHttpGetFails(t *testing.T) {
 	}
 	c := New(apiKey, secret, newHTTPClient(getFn))
 
-	resp, e := fetch(c, url_)
+	resp, e := fetch(context.Background(), c, url_)
 	assert(t, "resp", resp == nil)
-	assertEq(t, "err", fmt.Sprintf("GET failed: Get %s: %s", url_, err), e.Error())
+	assertEq(t, "err", fmt.Sprintf("GET failed: Get %q: %s", url_, err), e.Error())
 }
 
 func TestFetchSuccess(t *testing.T) {
@@ -148,14 +199,14 @@ func TestFetchSuccess(t *testing.T) {
 	expectedData := bytes.NewBufferString("response from Flickr").Bytes()
 	body := fakeBody{data: expectedData}
 	currentBody = body
-	resp := http.Response{Body: body}
+	resp := http.Response{StatusCode: http.StatusOK, Body: body}
 	getFn := func(r *http.Request) (*http.Response, error) {
 		assertEq(t, "url", url_, r.URL.String())
 		return &resp, nil
 	}
 	c := New(apiKey, secret, newHTTPClient(getFn))
 
-	in, e := fetch(c, url_)
+	in, e := fetch(context.Background(), c, url_)
 	assertOK(t, "fetch", e)
 	buf := bytes.NewBuffer(nil)
 	_, cErr := io.Copy(buf, in)
@@ -163,38 +214,230 @@ func TestFetchSuccess(t *testing.T) {
 	assert(t, "data", bytes.Equal(expectedData, buf.Bytes()))
 }
 
+func TestFetchCancelledWhileWaiting(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		t.Errorf("request sent despite cancellation")
+		return nil, errors.New("unexpected")
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = NewTokenBucket(0.001, 1)
+	c.RateLimiter.Wait(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := fetch(ctx, c, "http://some.url/")
+	assertEq(t, "err", context.DeadlineExceeded, err)
+	assert(t, "returned early", time.Since(start) < 500*time.Millisecond)
+}
+
+func TestFetchCancelledInFlight(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	c := New(apiKey, secret, &http.Client{Transport: redirectTransport{target}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := c.PeopleGetInfoContext(ctx, PeopleGetInfoParams{UserID: "1@N01"})
+	assert(t, "err", err != nil)
+	assert(t, "message: "+err.Error(), strings.Contains(err.Error(), "context canceled"))
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestFlickrGetHTTPError(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("Bad Gateway ", 100) + "</body></html>"
+	body := &closeRecorder{Reader: strings.NewReader(page)}
+	getFn := func(r *http.Request) (*http.Response, error) {
+		h := make(http.Header)
+		h.Set("Retry-After", "120")
+		h.Set("Content-Type", "text/html")
+		return &http.Response{
+			StatusCode: http.StatusBadGateway,
+			Status:     "502 Bad Gateway",
+			Header:     h,
+			Body:       body,
+		}, nil
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	_, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+
+	var h *HTTPError
+	assert(t, "errors.As", errors.As(err, &h))
+	assertEq(t, "status code", http.StatusBadGateway, h.StatusCode)
+	assertEq(t, "status", "502 Bad Gateway", h.Status)
+	assertEq(t, "header", "text/html", h.Header.Get("Content-Type"))
+	assertEq(t, "retry after", 2*time.Minute, h.RetryAfter)
+	assertEq(t, "body", page[:errorBodyLimit], h.Body)
+	assert(t, "body closed", body.closed)
+	assert(t, "retryable", IsRetryable(err))
+	var apiErr *APIError
+	assert(t, "not an API error", !errors.As(err, &apiErr))
+}
+
+func TestFlickrGetTransportError(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	_, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+
+	var urlErr *url.Error
+	assert(t, "transport error", errors.As(err, &urlErr))
+	var h *HTTPError
+	assert(t, "not an HTTP error", !errors.As(err, &h))
+	assert(t, "not retryable", !IsRetryable(err))
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	assertEq(t, "empty", time.Duration(0), retryAfter("", now))
+	assertEq(t, "seconds", 5*time.Second, retryAfter("5", now))
+	assertEq(t, "date", 90*time.Second, retryAfter("Wed, 21 Oct 2015 07:29:30 GMT", now))
+	assertEq(t, "past date", time.Duration(0), retryAfter("Wed, 21 Oct 2015 07:00:00 GMT", now))
+	assertEq(t, "garbage", time.Duration(0), retryAfter("soon", now))
+}
+
+func TestResponseBodyLogging(t *testing.T) {
+	httpClient, _ := newSequenceClient(t, xmlResponse(personXML), xmlResponse(personXML))
+	c := New(apiKey, secret, httpClient)
+	logger := &testLogger{}
+	c.Logger = logger
+
+	_, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	assertOK(t, "PeopleGetInfo", err)
+	for _, l := range logger.lines {
+		assert(t, "body not logged: "+l, !strings.Contains(l, "Response body"))
+	}
+
+	logger.lines = nil
+	c.LogBodyLimit = 16
+	_, err = c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	assertOK(t, "PeopleGetInfo", err)
+	assertEq(t, "last line", "Response body (truncated) "+personXML[:16],
+		logger.lines[len(logger.lines)-1])
+}
+
+// Returns a flickr.photos.search response with n photos.
+func searchPageXML(n int) string {
+	buf := bytes.NewBufferString(`<?xml version="1.0" encoding="utf-8"?>
+    <rsp stat="ok">
+      <photos page="1" pages="40" perpage="500" total="20000">`)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(buf, `
+        <photo id="%d" owner="22@N01" secret="63562" server="3" farm="1"
+            title="photo %d" ispublic="1" isfriend="0" isfamily="0"
+            width_t="100" height_t="75"/>`, 1000000+i, i)
+	}
+	buf.WriteString(`
+      </photos>
+    </rsp>`)
+	return buf.String()
+}
+
+// Decodes a search page the way parseXML did before it streamed responses,
+// for comparison in BenchmarkSearchPageDecoding.
+func bufferedParseXML(in io.Reader, resp interface{}) error {
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buf, in); err != nil {
+		return err
+	}
+	return xml.NewDecoder(buf).Decode(resp)
+}
+
+func BenchmarkSearchPageDecoding(b *testing.B) {
+	page := searchPageXML(500)
+	decoders := []struct {
+		name  string
+		parse func(io.Reader, interface{}) error
+	}{
+		{"buffered", bufferedParseXML},
+		{"streaming", parseXML},
+	}
+	for _, d := range decoders {
+		b.Run(d.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(page)))
+			for i := 0; i < b.N; i++ {
+				r := struct {
+					apiStatus
+					Photos SearchResponse `xml:"photos"`
+				}{}
+				if err := d.parse(strings.NewReader(page), &r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPhotosSearch(b *testing.B) {
+	page := searchPageXML(500)
+	c := New(apiKey, secret, newHTTPClient(func(r *http.Request) (*http.Response, error) {
+		return xmlResponse(page)()
+	}))
+	c.RateLimiter = nil
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.PhotosSearch(PhotosSearchParams{PerPage: 500}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestUploadRequest(t *testing.T) {
-	data := []byte("123456\n78910\nasdfoiu\nasdfeejh")
+	data := []byte("\xff\xd8\xff\xe0123456\n78910\nasdfoiu\nasdfeejh")
 	filename := "kitten.JPEG"
 	args := map[string]string{
 		"title":       "kitten",
 		"description": "my cute kitten",
 	}
-	authToken := "ase878723623"
-	c := New(apiKey, secret, nil)
-	c.AuthToken = authToken
-	req, rqErr := uploadRequest(c, filename, data, args)
-	assertOK(t, "uploadRequest", rqErr)
+	c := New(apiKey, secret, nil).WithUser(Credentials{
+		Token:  "ase878723623",
+		Secret: "87dfe8a",
+	})
+	f, fErr := newUploadForm(c, c.uploadURL(), bytesFile(filename, data), args, true)
+	assertOK(t, "newUploadForm", fErr)
+	req, rqErr := f.request(c)
+	assertOK(t, "request", rqErr)
 	pErr := req.ParseMultipartForm(128)
 	assertOK(t, "parseForm", pErr)
 
-	args["api_key"] = apiKey
-	args["auth_token"] = authToken
-	args["async"] = "1"
-	apiSig := sign(secret, args)
-
 	form := req.MultipartForm
+	signed := make(map[string]string)
+	for k, v := range form.Value {
+		assertEq(t, k+" len", 1, len(v))
+		if k != "oauth_signature" {
+			signed[k] = v[0]
+		}
+	}
 	verify := func(key, value string) {
-		assertEq(t, key+" len", 1, len(form.Value[key]))
-		assertEq(t, key, value, form.Value[key][0])
+		assertEq(t, key, value, signed[key])
 	}
-	assertEq(t, "value len", 6, len(form.Value))
+	assertEq(t, "value len", 11, len(form.Value))
 	verify("title", "kitten")
 	verify("description", "my cute kitten")
 	verify("api_key", apiKey)
-	verify("auth_token", authToken)
-	verify("api_sig", apiSig)
 	verify("async", "1")
+	verify("oauth_consumer_key", apiKey)
+	verify("oauth_token", "ase878723623")
+	assertEq(t, "oauth_signature",
+		oauthSign(secret, "87dfe8a", "POST", flickrUploadURL, signed),
+		form.Value["oauth_signature"][0])
 
 	assertEq(t, "file len", 1, len(form.File))
 	assertEq(t, "photo len", 1, len(form.File["photo"]))
@@ -208,81 +451,461 @@ func TestUploadRequest(t *testing.T) {
 	assertEq(t, "photo", string(data), string(actual))
 }
 
-//-----------------------
+func TestPostRequest(t *testing.T) {
+	c := New(apiKey, secret, nil).WithUser(Credentials{
+		Token:  "ase878723623",
+		Secret: "87dfe8a",
+	})
+	req, err := postRequest(c, "flickr.photosets.delete", map[string]string{"photoset_id": "72"})
+	assertOK(t, "postRequest", err)
+	assertEq(t, "method", "POST", req.Method)
+	assertEq(t, "url", flickrRESTURL, req.URL.String())
+	assertEq(t, "content-type", "application/x-www-form-urlencoded", req.Header.Get("Content-Type"))
+	assertOK(t, "ParseForm", req.ParseForm())
+
+	signed := make(map[string]string)
+	for k, v := range req.PostForm {
+		if k != "oauth_signature" {
+			signed[k] = v[0]
+		}
+	}
+	assertEq(t, "method arg", "flickr.photosets.delete", signed["method"])
+	assertEq(t, "photoset_id", "72", signed["photoset_id"])
+	assertEq(t, "api_key", apiKey, signed["api_key"])
+	assertEq(t, "oauth_token", "ase878723623", signed["oauth_token"])
+	assertEq(t, "oauth_signature",
+		oauthSign(secret, "87dfe8a", "POST", flickrRESTURL, signed),
+		req.PostForm.Get("oauth_signature"))
+}
+
+func TestDetectContentType(t *testing.T) {
+	ts := func(n int, prefix string) string {
+		b := make([]byte, 2*n+1)
+		b[0], b[n], b[2*n] = 0x47, 0x47, 0x47
+		return prefix + string(b)
+	}
+	cases := []struct {
+		name, head, expected string
+	}{
+		{"a.png", "\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg"},
+		{"a", "\x89PNG\r\n\x1a\n\x00", "image/png"},
+		{"a", "GIF89a\x01\x00", "image/gif"},
+		{"a", "MM\x00*\x00\x00\x00\x08", "image/tiff"},
+		{"a", "RIFF\x00\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"a", "RIFF\x00\x00\x00\x00AVI LIST", "video/x-msvideo"},
+		{"a", "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00", "image/heic"},
+		{"a", "\x00\x00\x00\x18ftypisom\x00\x00\x02\x00", "video/mp4"},
+		{"a", "\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00", "video/quicktime"},
+		{"a", "\x00\x00\x00\x08wide", "video/quicktime"},
+		{"a", "\x00\x00\x01\xba\x44", "video/mpeg"},
+		{"a", ts(188, ""), "video/mp2t"},
+		{"a", ts(192, "\x00\x00\x00\x00"), "video/mp2t"},
+		{"a.MOV", "\x00\x01\x02\x03", "video/quicktime"},
+		{"a.heic", "", "image/heic"},
+	}
+	for _, c := range cases {
+		ct, err := DetectContentType(c.name, []byte(c.head))
+		assertOK(t, c.expected, err)
+		assertEq(t, c.expected, c.expected, ct)
+	}
+	for _, name := range []string{"a.pdf", "a", "a.txt", "a.jpg"} {
+		_, err := DetectContentType(name, []byte("%PDF-1.4"))
+		assert(t, name, errors.Is(err, ErrFiletypeUnsupported))
+	}
+	_, err := DetectContentType("a.png", []byte("BM\x00\x00"))
+	assert(t, "bmp named a.png", errors.Is(err, ErrFiletypeUnsupported))
+	_, err = DetectContentType("notes.jpg", []byte("just some text"))
+	assert(t, "text named notes.jpg", errors.Is(err, ErrFiletypeUnsupported))
+}
+
+func TestSniffFile(t *testing.T) {
+	data := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 1000)
+	f, ct, err := sniffFile(UploadFile{Name: "a", Reader: ioutil.NopCloser(strings.NewReader(data))})
+	assertOK(t, "sniffFile", err)
+	assertEq(t, "content type", "image/png", ct)
+	b, _ := ioutil.ReadAll(f.Reader)
+	assertEq(t, "unseekable data", data, string(b))
+
+	r := strings.NewReader("xx" + data)
+	r.Seek(2, io.SeekStart)
+	f, _, err = sniffFile(UploadFile{Name: "a", Reader: r})
+	assertOK(t, "sniffFile", err)
+	assert(t, "same reader", f.Reader == r)
+	b, _ = ioutil.ReadAll(f.Reader)
+	assertEq(t, "rewound data", data, string(b))
+
+	c := New(apiKey, secret, nil)
+	_, err = newUploadForm(c, c.uploadURL(), bytesFile("notes.txt", []byte("hello")), nil, true)
+	assert(t, "rejected", errors.Is(err, ErrFiletypeUnsupported))
+}
+
+func TestEndpoints(t *testing.T) {
+	var paths []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/rest":
+			q := r.URL.Query()
+			signed := make(map[string]string)
+			for k := range q {
+				if k != "oauth_signature" {
+					signed[k] = q.Get(k)
+				}
+			}
+			assertEq(t, "rest signature",
+				oauthSign(secret, "", "GET", srv.URL+"/rest", signed),
+				q.Get("oauth_signature"))
+			fmt.Fprint(w, personXML)
+		case "/oauth/request_token":
+			fmt.Fprint(w, "oauth_token=t&oauth_token_secret=s")
+		default:
+			fmt.Fprint(w, `<rsp stat="ok"><ticketid>1</ticketid></rsp>`)
+		}
+	}))
+	defer srv.Close()
+
+	c := New(apiKey, secret, http.DefaultClient)
+	c.Endpoints = Endpoints{
+		REST:   srv.URL + "/rest",
+		OAuth:  srv.URL + "/oauth/",
+		Upload: srv.URL + "/up",
+	}
+	_, err := c.WithUser(Credentials{}).PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	assertOK(t, "PeopleGetInfo", err)
+	_, err = c.GetRequestToken("oob")
+	assertOK(t, "GetRequestToken", err)
+	assertEq(t, "authorize", srv.URL+"/oauth/authorize?oauth_token=t", c.AuthURL("t", ""))
+	f, err := newUploadForm(c, c.uploadURL(), bytesFile("a.jpg", []byte("\xff\xd8\xff\xe0photo")), map[string]string{}, true)
+	assertOK(t, "newUploadForm", err)
+	req, err := f.request(c)
+	assertOK(t, "request", err)
+	assertEq(t, "upload url", srv.URL+"/up", req.URL.String())
+	assertEq(t, "paths", "GET /rest,GET /oauth/request_token", strings.Join(paths, ","))
+
+	u, _ := url.Parse(makeURL(New(apiKey, secret, nil), "flickr.test.echo", nil, false))
+	assertEq(t, "default", "api.flickr.com/services/rest/", u.Host+u.Path)
+}
+
+// -----------------------
 // Tests for flickr.go
-//
 func TestAuthURL(t *testing.T) {
 	c := New(apiKey, secret, nil)
 
-	u, uErr := url.Parse(c.AuthURL(ReadPerm))
+	u, uErr := url.Parse(c.AuthURL("72157626737672178-022bbd2f4c2f3432", ReadPerm))
 	assertOK(t, "parseURL", uErr)
 	args, qErr := url.ParseQuery(u.RawQuery)
 	assertOK(t, "parseQuery", qErr)
 
-	for _, key := range []string{"api_key", "perms", "api_sig"} {
+	assertEq(t, "host", "www.flickr.com", u.Host)
+	assertEq(t, "path", "/services/oauth/authorize", u.Path)
+	for _, key := range []string{"oauth_token", "perms"} {
 		if len(args[key]) != 1 {
 			t.Errorf("Query argument %s has value %v", key, args[key])
 		}
 	}
-	assertEq(t, "api_key", apiKey, args["api_key"][0])
+	assertEq(t, "oauth_token", "72157626737672178-022bbd2f4c2f3432", args["oauth_token"][0])
 	assertEq(t, "perms", ReadPerm, args["perms"][0])
 }
 
-func TestGetTokenURL(t *testing.T) {
-	frob := "837cjnei"
+// Redirects all requests to a test server, leaving the Host header intact so
+// that the server can verify signatures against the original URL.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (rt redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r2 := r.Clone(r.Context())
+	r2.Host = r.URL.Host
+	r2.URL.Scheme = rt.target.Scheme
+	r2.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(r2)
+}
+
+// Escapes s per RFC 5849.  Written independently of oauthEscape so that the
+// test server does not share bugs with the code under test.
+func testEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// Stand-in for Flickr's OAuth endpoints.  It rejects requests whose
+// signatures do not verify with the consumer secret and the secret of the
+// token sent with the request.
+func newOAuthServer(t *testing.T) (*httptest.Server, *http.Client) {
+	tokenSecrets := map[string]string{
+		"":                                   "",
+		"72157626737672178-022bbd2f4c2f3432": "fccb68c4e6103197",
+	}
+	h := func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var names []string
+		for k := range q {
+			if k != "oauth_signature" {
+				names = append(names, testEscape(k))
+			}
+		}
+		// Parameters are sorted by name, then by value.
+		sort.Strings(names)
+		pairs := []string{}
+		for _, k := range names {
+			var vs []string
+			for _, v := range q[k] {
+				vs = append(vs, testEscape(v))
+			}
+			sort.Strings(vs)
+			for _, v := range vs {
+				pairs = append(pairs, k+"="+v)
+			}
+		}
+		base := r.Method + "&" + testEscape("https://"+r.Host+r.URL.Path) + "&" +
+			testEscape(strings.Join(pairs, "&"))
+		tokenSecret, ok := tokenSecrets[q.Get("oauth_token")]
+		m := hmac.New(sha1.New, []byte(testEscape(secret)+"&"+testEscape(tokenSecret)))
+		write(m, base)
+		if !ok || q.Get("oauth_signature") != base64.StdEncoding.EncodeToString(m.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "oauth_problem=signature_invalid&debug_sbs="+url.QueryEscape(base))
+			return
+		}
+		switch r.URL.Path {
+		case "/services/oauth/request_token":
+			assertEq(t, "oauth_callback", "http://www.example.com", q.Get("oauth_callback"))
+			fmt.Fprint(w, "oauth_callback_confirmed=true&"+
+				"oauth_token=72157626737672178-022bbd2f4c2f3432&"+
+				"oauth_token_secret=fccb68c4e6103197")
+		case "/services/oauth/access_token":
+			if q.Get("oauth_verifier") != "5d1b96a26b494074" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, "oauth_problem=token_rejected")
+				return
+			}
+			fmt.Fprint(w, "fullname=Jamal%20Fanaian&"+
+				"oauth_token=72157626318069415-087bfc7b5816092c&"+
+				"oauth_token_secret=a202d1f853ec69de&"+
+				"user_nsid=21207597%40N07&username=jamalfanaian")
+		case "/services/rest/":
+			fmt.Fprint(w, `<rsp stat="ok" />`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(h))
+	target, _ := url.Parse(srv.URL)
+	return srv, &http.Client{Transport: redirectTransport{target}}
+}
+
+func TestOAuthFlow(t *testing.T) {
+	srv, httpClient := newOAuthServer(t)
+	defer srv.Close()
+	c := New(apiKey, secret, httpClient)
+
+	rt, err := c.GetRequestToken("http://www.example.com")
+	assertOK(t, "GetRequestToken", err)
+	assertEq(t, "request token", "72157626737672178-022bbd2f4c2f3432", rt.Token)
+	assertEq(t, "request token secret", "fccb68c4e6103197", rt.Secret)
+	assertEq(t, "callback confirmed", true, rt.CallbackConfirmed)
+
+	at, err := c.GetAccessToken(rt, "5d1b96a26b494074")
+	assertOK(t, "GetAccessToken", err)
+	assertEq(t, "token", "72157626318069415-087bfc7b5816092c", at.Token)
+	assertEq(t, "secret", "a202d1f853ec69de", at.Secret)
+	assertEq(t, "fullname", "Jamal Fanaian", at.User.FullName)
+	assertEq(t, "username", "jamalfanaian", at.User.UserName)
+	assertEq(t, "nsid", "21207597@N07", at.User.NSID)
+}
+
+func TestOAuthPrefixedNames(t *testing.T) {
+	args := map[string]string{"a": "x", "a1": "y", "a-b": "z"}
+	base := oauthBaseString("GET", "http://some.url/", args)
+	assertEq(t, "base", "GET&http%3A%2F%2Fsome.url%2F&a%3Dx%26a-b%3Dz%26a1%3Dy", base)
+
+	srv, httpClient := newOAuthServer(t)
+	defer srv.Close()
+	c := New(apiKey, secret, httpClient).WithUser(Credentials{
+		Token:  "72157626737672178-022bbd2f4c2f3432",
+		Secret: "fccb68c4e6103197",
+	})
+	c.RateLimiter = nil
+	assertOK(t, "PushSubscribe", c.PushSubscribe(args))
+}
+
+func TestOAuthFlowFailures(t *testing.T) {
+	srv, httpClient := newOAuthServer(t)
+	defer srv.Close()
+
+	c := New(apiKey, "wrong secret", httpClient)
+	_, err := c.GetRequestToken("http://www.example.com")
+	assert(t, "bad signature", err != nil)
+	assert(t, "message: "+err.Error(),
+		strings.Contains(err.Error(), "signature_invalid"))
+
+	c = New(apiKey, secret, httpClient)
+	rt := &RequestToken{
+		Token:  "72157626737672178-022bbd2f4c2f3432",
+		Secret: "fccb68c4e6103197",
+	}
+	_, err = c.GetAccessToken(rt, "bad verifier")
+	assert(t, "bad verifier", err != nil)
+	assert(t, "message: "+err.Error(),
+		strings.Contains(err.Error(), "token_rejected"))
+}
+
+func TestLegacyURL(t *testing.T) {
 	c := New(apiKey, secret, nil)
 
-	u, uErr := url.Parse(getTokenURL(c, frob))
+	u, uErr := url.Parse(legacyURL(c, "flickr.auth.oauth.getAccessToken",
+		map[string]string{}, "72157607082540144-d2a3e8d7a9e1e5d1"))
 	assertOK(t, "parseURL", uErr)
-	args, err := url.ParseQuery(u.RawQuery)
+	a, err := url.ParseQuery(u.RawQuery)
 	assertOK(t, "parseQuery", err)
-	assertEq(t, "method", "flickr.auth.getToken", args["method"][0])
-	assertEq(t, "frob", frob, args["frob"][0])
-	assertEq(t, "api_key", apiKey, args["api_key"][0])
-	assertEq(t, "api_sig", 1, len(args["api_sig"]))
+
+	m := md5.New()
+	write(m, secret)
+	write(m, "api_key"+apiKey)
+	write(m, "auth_token"+"72157607082540144-d2a3e8d7a9e1e5d1")
+	write(m, "method"+"flickr.auth.oauth.getAccessToken")
+	assertEq(t, "method", "flickr.auth.oauth.getAccessToken", a.Get("method"))
+	assertEq(t, "auth_token", "72157607082540144-d2a3e8d7a9e1e5d1", a.Get("auth_token"))
+	assertEq(t, "api_key", apiKey, a.Get("api_key"))
+	assertEq(t, "api_sig", fmt.Sprintf("%x", m.Sum(nil)), a.Get("api_sig"))
 }
 
-func TestGetTokenAPIFailure(t *testing.T) {
-	xmlStr := `<?xml version="1.0" encoding="utf-8"?>
-    <rsp stat="fail">
-      <err code="97" msg="Missing signature"/>
+const checkTokenXML = `<rsp stat="ok"><oauth><token>new</token><perms>write</perms>
+    <user nsid="1121451801@N07" username="jamalf" fullname="Jamal F" /></oauth></rsp>`
+
+func TestExchangeAuthToken(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8" ?>
+    <rsp stat="ok">
+      <auth>
+        <access_token oauth_token="72157607082540144-8d5d7ea7696629bf"
+            oauth_token_secret="f38bf58b2d95bc8b" />
+      </auth>
     </rsp>`
-	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
-	body := fakeBody{data: xmlBytes}
-	currentBody = body
-	resp := http.Response{Body: body}
+	checkFails := false
 	getFn := func(r *http.Request) (*http.Response, error) {
-		return &resp, nil
+		q := r.URL.Query()
+		if q.Get("method") == "flickr.auth.oauth.checkToken" {
+			assertEq(t, "oauth_token", "72157607082540144-8d5d7ea7696629bf", q.Get("oauth_token"))
+			if checkFails {
+				return statusResponse(http.StatusInternalServerError)()
+			}
+			return xmlResponse(checkTokenXML)()
+		}
+		assertEq(t, "auth_token", "old-token", q.Get("auth_token"))
+		return xmlResponse(xmlStr)()
 	}
 	c := New(apiKey, secret, newHTTPClient(getFn))
-	_, _, err := c.GetToken("878243")
-	assert(t, "err", err != nil)
-	assert(t, "message: "+err.Error(),
-		strings.Contains(err.Error(), "code 97: Missing signature"))
+	c.RateLimiter = nil
+	at, err := c.ExchangeAuthToken("old-token")
+	assertOK(t, "ExchangeAuthToken", err)
+	assertEq(t, "token", "72157607082540144-8d5d7ea7696629bf", at.Token)
+	assertEq(t, "secret", "f38bf58b2d95bc8b", at.Secret)
+	assertEq(t, "nsid", "1121451801@N07", at.User.NSID)
+	assertEq(t, "perms", WritePerm, at.Perms)
+	assertEq(t, "credentials", Credentials{
+		Token:  "72157607082540144-8d5d7ea7696629bf",
+		Secret: "f38bf58b2d95bc8b",
+		NSID:   "1121451801@N07",
+		Perms:  WritePerm,
+	}, at.Credentials())
+
+	// The new token is not lost when its user cannot be looked up.
+	checkFails = true
+	at, err = c.ExchangeAuthToken("old-token")
+	assert(t, "check failed", err != nil)
+	assertEq(t, "token kept", "72157607082540144-8d5d7ea7696629bf", at.Token)
 }
 
-func TestGetToken(t *testing.T) {
-	xmlStr := `<?xml version="1.0" encoding="utf-8"?>
+func TestCheckToken(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8" ?>
     <rsp stat="ok">
-      <auth>
-        <token>121-84669832774</token>
+      <oauth>
+        <token>72157627611980735-09e87c3024f733da</token>
         <perms>write</perms>
-        <user nsid="7687633@N01" username="testuser" fullname="Test User"/>
-      </auth>
+        <user nsid="1121451801@N07" username="jamalf" fullname="Jamal F" />
+      </oauth>
     </rsp>`
-	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
-	body := fakeBody{data: xmlBytes}
-	currentBody = body
-	resp := http.Response{Body: body}
+	currentBody = fakeBody{data: []byte(xmlStr)}
+	resp := http.Response{StatusCode: http.StatusOK, Body: currentBody}
 	getFn := func(r *http.Request) (*http.Response, error) {
+		q := r.URL.Query()
+		assertEq(t, "method", "flickr.auth.oauth.checkToken", q.Get("method"))
+		assertEq(t, "oauth_token", "72157627611980735-09e87c3024f733da", q.Get("oauth_token"))
 		return &resp, nil
 	}
 	c := New(apiKey, secret, newHTTPClient(getFn))
-	tok, user, err := c.GetToken("878243")
-	assertOK(t, "GetToken", err)
-	assertEq(t, "token", "121-84669832774", tok)
-	assertEq(t, "username", "testuser", user.UserName)
-	assertEq(t, "nsid", "7687633@N01", user.NSID)
+	info, err := c.CheckToken("72157627611980735-09e87c3024f733da", "a202d1f853ec69de")
+	assertOK(t, "CheckToken", err)
+	assertEq(t, "token", "72157627611980735-09e87c3024f733da", info.Token)
+	assertEq(t, "perms", WritePerm, info.Perms)
+	assertEq(t, "nsid", "1121451801@N07", info.User.NSID)
+	assertEq(t, "username", "jamalf", info.User.UserName)
+	assertEq(t, "fullname", "Jamal F", info.User.FullName)
+}
+
+func TestMigrateAuthTokens(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		if r.URL.Query().Get("method") == "flickr.auth.oauth.checkToken" {
+			return xmlResponse(checkTokenXML)()
+		}
+		var xmlStr string
+		switch r.URL.Query().Get("auth_token") {
+		case "good":
+			xmlStr = `<rsp stat="ok"><auth>
+			    <access_token oauth_token="new" oauth_token_secret="s" />
+			  </auth></rsp>`
+		case "bad":
+			xmlStr = `<rsp stat="fail"><err code="98" msg="Invalid token" /></rsp>`
+		default:
+			return nil, errors.New("connection reset")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	r := c.MigrateAuthTokens([]string{"good", "bad", "unreachable"})
+	assertEq(t, "len", 3, len(r))
+
+	assertEq(t, "0.auth_token", "good", r[0].AuthToken)
+	assertOK(t, "0.err", r[0].Err)
+	assertEq(t, "0.token", "new", r[0].AccessToken.Token)
+	assertEq(t, "0.secret", "s", r[0].AccessToken.Secret)
+	assertEq(t, "0.nsid", "1121451801@N07", r[0].AccessToken.Credentials().NSID)
+
+	assertEq(t, "1.auth_token", "bad", r[1].AuthToken)
+	assert(t, "1.err", r[1].Err != nil && strings.Contains(r[1].Err.Error(), "code 98"))
+	assert(t, "1.access_token", r[1].AccessToken == nil)
+
+	assertEq(t, "2.auth_token", "unreachable", r[2].AuthToken)
+	assert(t, "2.err", r[2].Err != nil)
+}
+
+func TestWithUser(t *testing.T) {
+	var tokens []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		tokens = append(tokens, r.URL.Query().Get("oauth_token"))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(`<rsp stat="ok"/>`)),
+		}, nil
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	alice := c.WithUser(Credentials{Token: "alice", Secret: "a", NSID: "1@N01"})
+	bob := c.WithUser(Credentials{Token: "bob", Secret: "b"})
+
+	assert(t, "shared limiter", alice.RateLimiter == c.RateLimiter && bob.RateLimiter == c.RateLimiter)
+	assert(t, "shared quota", alice.quota == c.quota && bob.quota == c.quota)
+	assert(t, "shared http client", alice.httpClient == c.httpClient)
+	assertEq(t, "parent creds", Credentials{}, c.Credentials())
+	assertEq(t, "alice nsid", "1@N01", alice.Credentials().NSID)
+
+	for _, cl := range []*Client{alice, bob, c} {
+		assertOK(t, "PushSubscribe", cl.PushSubscribe(map[string]string{}))
+	}
+	assertEq(t, "len", 3, len(tokens))
+	assertEq(t, "alice", "alice", tokens[0])
+	assertEq(t, "bob", "bob", tokens[1])
+	assertEq(t, "anonymous", "", tokens[2])
+	assertEq(t, "quota", Quota{Used: 3, Limit: HourlyLimit, Remaining: HourlyLimit - 3}, bob.Quota())
 }
 
 func TestUploadFails(t *testing.T) {
@@ -293,13 +916,13 @@ func TestUploadFails(t *testing.T) {
 	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
 	body := fakeBody{data: xmlBytes}
 	currentBody = body
-	resp := http.Response{Body: body}
+	resp := http.Response{StatusCode: http.StatusOK, Body: body}
 	postFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
 	c := New(apiKey, secret, newHTTPClient(postFn))
-	ticket, err := c.Upload("filename", []byte("photo content"),
-		map[string]string{})
+	ticket, err := c.Upload("filename.jpg", []byte("\xff\xd8\xff\xe0photo content"),
+		UploadParams{})
 	assert(t, "message: "+err.Error(),
 		strings.Contains(err.Error(), "code 5: Filetype was not recognised"))
 	assertEq(t, "ticket", "", ticket)
@@ -313,17 +936,168 @@ func TestUpload(t *testing.T) {
 	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
 	body := fakeBody{data: xmlBytes}
 	currentBody = body
-	resp := http.Response{Body: body}
+	resp := http.Response{StatusCode: http.StatusOK, Body: body}
 	postFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
 	c := New(apiKey, secret, newHTTPClient(postFn))
-	ticket, err := c.Upload("filename", make([]byte, 1024*1024),
-		map[string]string{})
+	ticket, err := c.Upload("filename.jpg", append([]byte("\xff\xd8\xff\xe0"), make([]byte, 1024*1024)...),
+		UploadParams{})
 	assertOK(t, "upload", err)
 	assertEq(t, "ticket", "363", ticket)
 }
 
+func TestUploadParams(t *testing.T) {
+	p := UploadParams{
+		Title:       "kitten",
+		Tags:        []string{"cat", "new york", "cute"},
+		IsPublic:    Bool(false),
+		IsFamily:    Bool(true),
+		SafetyLevel: SafetyModerate,
+		ContentType: ContentScreenshot,
+		Hidden:      SearchHidden,
+	}
+	args, err := p.args()
+	assertOK(t, "args", err)
+	assertEq(t, "len", 7, len(args))
+	assertEq(t, "title", "kitten", args["title"])
+	assertEq(t, "tags", `cat "new york" cute`, args["tags"])
+	assertEq(t, "is_public", "0", args["is_public"])
+	assertEq(t, "is_family", "1", args["is_family"])
+	assertEq(t, "safety_level", "2", args["safety_level"])
+	assertEq(t, "content_type", "2", args["content_type"])
+	assertEq(t, "hidden", "2", args["hidden"])
+
+	args, err = (&UploadParams{}).args()
+	assertOK(t, "empty", err)
+	assertEq(t, "empty len", 0, len(args))
+
+	invalid := []UploadParams{
+		{SafetyLevel: 4},
+		{ContentType: -1},
+		{Hidden: 3},
+		{Tags: []string{`say "cheese"`}},
+		{Tags: []string{" "}},
+	}
+	getFn := func(r *http.Request) (*http.Response, error) {
+		t.Errorf("request sent with invalid parameters")
+		return nil, errors.New("unexpected")
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	for i, p := range invalid {
+		_, err := c.Upload("a.jpg", []byte("\xff\xd8\xff\xe0photo"), p)
+		assert(t, fmt.Sprintf("invalid %d", i), err != nil)
+	}
+}
+
+func TestUploadSyncAndReplace(t *testing.T) {
+	var requests []string
+	responses := []string{
+		`<rsp stat="ok"><photoid>1234</photoid></rsp>`,
+		`<rsp stat="ok"><photoid secret="abc" originalsecret="def">1234</photoid></rsp>`,
+		`<rsp stat="ok"><ticketid>99</ticketid></rsp>`,
+		`<rsp stat="fail"><err code="6" msg="User exceeded upload limit" /></rsp>`,
+	}
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertOK(t, "parseForm", r.ParseMultipartForm(1024))
+		v := r.MultipartForm.Value
+		requests = append(requests, fmt.Sprintf("%s async=%v photo_id=%v",
+			r.URL.Path, v["async"], v["photo_id"]))
+		return xmlResponse(responses[len(requests)-1])()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+
+	id, err := c.UploadSync(bytesFile("a.jpg", []byte("\xff\xd8\xff\xe0photo")), UploadParams{})
+	assertOK(t, "UploadSync", err)
+	assertEq(t, "photo id", "1234", id)
+	p, err := c.Replace("1234", bytesFile("a.jpg", []byte("\xff\xd8\xff\xe0edited")))
+	assertOK(t, "Replace", err)
+	assertEq(t, "replaced", ReplacedPhoto{ID: "1234", Secret: "abc", OriginalSecret: "def"}, *p)
+	ticket, err := c.ReplaceAsync("1234", bytesFile("a.jpg", []byte("\xff\xd8\xff\xe0edited")))
+	assertOK(t, "ReplaceAsync", err)
+	assertEq(t, "ticket", "99", ticket)
+	_, err = c.UploadSync(bytesFile("a.jpg", []byte("\xff\xd8\xff\xe0photo")), UploadParams{})
+	assert(t, "ErrUploadLimitExceeded", errors.Is(err, ErrUploadLimitExceeded))
+	assert(t, "not ErrFileSizeZero", !errors.Is(err, ErrFileSizeZero))
+	assert(t, "APIError", errors.Is(err, &APIError{Method: "upload", Code: ErrCodeUploadLimitExceeded}))
+
+	assertEq(t, "requests", "/services/upload async=[] photo_id=[]\n"+
+		"/services/replace async=[] photo_id=[1234]\n"+
+		"/services/replace async=[1] photo_id=[1234]\n"+
+		"/services/upload async=[] photo_id=[]", strings.Join(requests, "\n"))
+
+	// Codes shared with other methods only match the sentinels for uploads.
+	assert(t, "other method", !errors.Is(&APIError{Method: "flickr.photos.search", Code: 4},
+		ErrFileSizeZero))
+}
+
+func TestUploadStream(t *testing.T) {
+	data := "\xff\xd8\xff\xe0" + strings.Repeat("0123456789", 10000)
+	var photos []string
+	var lengths []int64
+	getFn := func(r *http.Request) (*http.Response, error) {
+		lengths = append(lengths, r.ContentLength)
+		if err := r.ParseMultipartForm(1024); err != nil {
+			return nil, err
+		}
+		f, _ := r.MultipartForm.File["photo"][0].Open()
+		b, _ := ioutil.ReadAll(f)
+		photos = append(photos, string(b))
+		if len(photos) == 1 {
+			return statusResponse(http.StatusServiceUnavailable)()
+		}
+		return xmlResponse(`<rsp stat="ok"><ticketid>363</ticketid></rsp>`)()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.Retry = &RetryPolicy{
+		MaxAttempts: 2,
+		BaseDelay:   time.Millisecond,
+		Methods:     map[string]bool{"upload": true},
+	}
+
+	// Readers that cannot be rewound are sent once, in chunks.
+	var sent, total int64
+	progress := func(s, t int64) { sent, total = s, t }
+	_, err := c.UploadStream(UploadFile{
+		Name:     "a.jpg",
+		Reader:   ioutil.NopCloser(strings.NewReader(data)),
+		Progress: progress,
+	}, UploadParams{})
+	assert(t, "not retried", err != nil)
+	assertEq(t, "attempts", 1, len(photos))
+	assertEq(t, "chunked", int64(-1), lengths[0])
+	assertEq(t, "photo", data, photos[0])
+	assertEq(t, "sent", int64(len(data)), sent)
+	assertEq(t, "unknown total", int64(0), total)
+
+	// Seekable readers are rewound for retries.
+	photos, lengths = nil, nil
+	r := strings.NewReader("xx" + data)
+	r.Seek(2, io.SeekStart)
+	ticket, err := c.UploadStream(UploadFile{
+		Name:     "a.jpg",
+		Reader:   r,
+		Size:     int64(len(data)),
+		Progress: progress,
+	}, UploadParams{Title: "a"})
+	assertOK(t, "UploadStream", err)
+	assertEq(t, "ticket", "363", ticket)
+	assertEq(t, "attempts", 2, len(photos))
+	assertEq(t, "replayed", data, photos[1])
+	assertEq(t, "content length", lengths[0], lengths[1])
+	assert(t, "content length", lengths[0] > int64(len(data)))
+	assertEq(t, "total", int64(len(data)), total)
+
+	// Sizes that do not match the data fail the upload.
+	c.Retry = nil
+	_, err = c.UploadStream(UploadFile{
+		Name:   "a.jpg",
+		Reader: strings.NewReader(data),
+		Size:   int64(len(data)) + 1,
+	}, UploadParams{})
+	assert(t, "size mismatch", err != nil)
+}
+
 func TestSearchURL(t *testing.T) {
 	args := map[string]string{
 		"per_page": "10",
@@ -339,7 +1113,7 @@ func TestSearchURL(t *testing.T) {
 	assertEq(t, "per_page", "10", a["per_page"][0])
 	assertEq(t, "user_id", "me", a["user_id"][0])
 	assertEq(t, "api_key", apiKey, a["api_key"][0])
-	assertEq(t, "api_sig", 1, len(a["api_sig"]))
+	assertEq(t, "oauth_signature", 1, len(a["oauth_signature"]))
 }
 
 func TestSearch(t *testing.T) {
@@ -357,17 +1131,17 @@ func TestSearch(t *testing.T) {
 	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
 	body := fakeBody{data: xmlBytes}
 	currentBody = body
-	resp := http.Response{Body: body}
+	resp := http.Response{StatusCode: http.StatusOK, Body: body}
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
 	c := New(apiKey, secret, newHTTPClient(getFn))
-	r, err := c.Search(map[string]string{})
+	r, err := c.PhotosSearch(PhotosSearchParams{})
 	assertOK(t, "search", err)
-	assertEq(t, "page", "1", r.Page)
-	assertEq(t, "pages", "3", r.Pages)
-	assertEq(t, "perpage", "2", r.PerPage)
-	assertEq(t, "total", "5", r.Total)
+	assertEq(t, "page", 1, r.Page)
+	assertEq(t, "pages", 3, r.Pages)
+	assertEq(t, "perpage", 2, r.PerPage)
+	assertEq(t, "total", 5, r.Total)
 	assertEq(t, "len photos", 2, len(r.Photos))
 
 	verify := func(p Photo, idx int,
@@ -411,9 +1185,7 @@ func TestCheckTicketsURL(t *testing.T) {
 		"23232",
 		"65876",
 	}
-	c := New(apiKey, secret, nil)
-	authToken := "ase878723623"
-	c.AuthToken = authToken
+	c := New(apiKey, secret, nil).WithUser(Credentials{Token: "ase878723623"})
 
 	u, uErr := url.Parse(checkTicketsURL(c, tickets))
 	assertOK(t, "parseURL", uErr)
@@ -435,7 +1207,7 @@ func TestCheckTickets(t *testing.T) {
 	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
 	body := fakeBody{data: xmlBytes}
 	currentBody = body
-	resp := http.Response{Body: body}
+	resp := http.Response{StatusCode: http.StatusOK, Body: body}
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
@@ -456,18 +1228,61 @@ func TestCheckTickets(t *testing.T) {
 	verify(statuses[2], 2, "333", "", "1", "")
 }
 
-func TestGetPhotoSetsURL(t *testing.T) {
-	userID := "7687633@N01"
-	c := New(apiKey, secret, nil)
-	authToken := "ase878723623"
-	c.AuthToken = authToken
+func TestWaitForTickets(t *testing.T) {
+	defer func(d, m time.Duration) { ticketPollDelay, ticketPollMaxDelay = d, m }(
+		ticketPollDelay, ticketPollMaxDelay)
+	ticketPollDelay, ticketPollMaxDelay = time.Millisecond, 2*time.Millisecond
 
-	u, uErr := url.Parse(getPhotoSetsURL(c, userID))
-	assertOK(t, "parseURL", uErr)
-	a, err := url.ParseQuery(u.RawQuery)
-	assertOK(t, "parseQuery", err)
-	assertEq(t, "method", "flickr.photosets.getList", a["method"][0])
-	assertEq(t, "user_id", userID, a["user_id"][0])
+	var polled []string
+	responses := []string{
+		`<rsp stat="ok"><uploader>
+          <ticket id="1" complete="0"/><ticket id="2" complete="0"/>
+          <ticket id="3" invalid="1"/><ticket id="4" complete="0"/>
+        </uploader></rsp>`,
+		`<rsp stat="ok"><uploader>
+          <ticket id="1" complete="1" photoid="101"/><ticket id="2" complete="0"/>
+          <ticket id="4" complete="2"/>
+        </uploader></rsp>`,
+		`<rsp stat="ok"><uploader>
+          <ticket id="2" complete="1" photoid="102"/>
+        </uploader></rsp>`,
+	}
+	getFn := func(r *http.Request) (*http.Response, error) {
+		polled = append(polled, r.URL.Query().Get("tickets"))
+		return xmlResponse(responses[len(polled)-1])()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	ids, err := c.WaitForTickets([]string{"1", "2", "3", "4"})
+	assertEq(t, "polled", "1,2,3,4 1,2,4 2", strings.Join(polled, " "))
+	assertEq(t, "ids", "101 102  ", strings.Join(ids, " "))
+	var te *TicketError
+	assert(t, "TicketError", errors.As(err, &te))
+	assertEq(t, "message", "invalid upload ticket 3\nprocessing upload ticket 4 failed", err.Error())
+
+	httpClient, n := newSequenceClient(t,
+		xmlResponse(`<rsp stat="ok"><uploader><ticket id="1" complete="0"/></uploader></rsp>`))
+	c = New(apiKey, secret, httpClient)
+	ticketPollDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.WaitForTicketsContext(ctx, []string{"1"})
+	assertEq(t, "cancelled", context.DeadlineExceeded, err)
+	assertEq(t, "polls", 1, *n)
+}
+
+func TestContextVariants(t *testing.T) {
+	ct := reflect.TypeOf(New(apiKey, secret, nil))
+	ctxType := reflect.TypeOf((*context.Context)(nil)).Elem()
+	errType := reflect.TypeOf((*error)(nil)).Elem()
+	for i := 0; i < ct.NumMethod(); i++ {
+		m := ct.Method(i).Type
+		if strings.HasSuffix(ct.Method(i).Name, "Context") || m.NumOut() == 0 ||
+			m.Out(m.NumOut()-1) != errType || (m.NumIn() > 1 && m.In(1) == ctxType) {
+			continue
+		}
+		_, ok := ct.MethodByName(ct.Method(i).Name + "Context")
+		assert(t, ct.Method(i).Name+"Context", ok)
+	}
 }
 
 func TestGetSets(t *testing.T) {
@@ -487,11 +1302,16 @@ func TestGetSets(t *testing.T) {
 	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
 	body := fakeBody{data: xmlBytes}
 	currentBody = body
-	resp := http.Response{Body: body}
+	resp := http.Response{StatusCode: http.StatusOK, Body: body}
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
 	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.GetSetsContext(ctx, "me")
+	assert(t, "cancelled", errors.Is(err, context.Canceled))
 	sets, err := c.GetSets("me")
 	assertOK(t, "getPhotoSets", err)
 	assertEq(t, "len(sets)", 2, len(sets))
@@ -506,6 +1326,159 @@ func TestGetSets(t *testing.T) {
 	verify(sets[1], 1, "65656", "Sophie", "Photos and videos of Sophie")
 }
 
+func TestPhotosetsGetInfo(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <photoset id="72157624618609504" owner="34427469121@N01" username="Bees"
+          primary="4847770787" secret="6abd09a292" server="4153" farm="5"
+          photos="55" videos="2" count_views="298" count_comments="1"
+          can_comment="1" date_create="1280530593" date_update="1308091378">
+        <title>Mah Kittehs</title>
+        <description>Sixty and Niner.</description>
+      </photoset>
+    </rsp>`
+	httpClient, _ := newSequenceClient(t, xmlResponse(xmlStr))
+	c := New(apiKey, secret, httpClient)
+	s, err := c.PhotosetsGetInfo(PhotosetsGetInfoParams{PhotosetID: "72157624618609504"})
+	assertOK(t, "PhotosetsGetInfo", err)
+	assertEq(t, "id", "72157624618609504", s.ID)
+	assertEq(t, "owner", "34427469121@N01", s.Owner)
+	assertEq(t, "username", "Bees", s.UserName)
+	assertEq(t, "title", "Mah Kittehs", s.Title)
+	assertEq(t, "photos", 55, s.Photos)
+	assertEq(t, "videos", 2, s.Videos)
+	assertEq(t, "views", 298, s.CountViews)
+	assertEq(t, "comments", 1, s.CountComments)
+	assertEq(t, "created", int64(1280530593), s.DateCreate.Unix())
+	assertEq(t, "updated", int64(1308091378), s.DateUpdate.Unix())
+	assertEq(t, "primary", "http://farm5.static.flickr.com/4153/4847770787_6abd09a292_s.jpg",
+		s.PrimaryURL(SizeSmallSquare))
+
+	var empty UnixTime
+	assertOK(t, "empty time", empty.UnmarshalText([]byte("0")))
+	assert(t, "empty time.IsZero", empty.IsZero())
+	assert(t, "bad time", empty.UnmarshalText([]byte("yesterday")) != nil)
+}
+
+func TestPhotosetsGetListPages(t *testing.T) {
+	page := func(n int) string {
+		return fmt.Sprintf(`<rsp stat="ok">
+      <photosets page="%d" pages="2" perpage="1" total="2" cancreate="1">
+        <photoset id="%d" primary="9" secret="s" server="1" farm="1" photos="3">
+          <title>Set %d</title>
+          <primary_photo_extras width_t="%d00" />
+        </photoset>
+      </photosets>
+    </rsp>`, n, n, n, n)
+	}
+	var pages []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		q := r.URL.Query()
+		assertEq(t, "method", "flickr.photosets.getList", q.Get("method"))
+		assertEq(t, "extras", "url_t", q.Get("primary_photo_extras"))
+		pages = append(pages, q.Get("page"))
+		n, _ := strconv.Atoi(q.Get("page"))
+		return xmlResponse(page(n))()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	var titles []string
+	for p := 1; ; p++ {
+		r, err := c.PhotosetsGetList(PhotosetsGetListParams{Page: p, PerPage: 1, PrimaryPhotoExtras: "url_t"})
+		assertOK(t, "PhotosetsGetList", err)
+		if err != nil {
+			break
+		}
+		assertEq(t, "total", 2, r.Total)
+		assertEq(t, "cancreate", 1, r.CanCreate)
+		for _, s := range r.Photosets {
+			titles = append(titles, s.Title)
+			assertEq(t, "width_t", fmt.Sprintf("%d00", p), s.PrimaryPhotoExtras.WidthT)
+		}
+		if p >= r.Pages {
+			break
+		}
+	}
+	assertEq(t, "pages", "1,2", strings.Join(pages, ","))
+	assertEq(t, "titles", "Set 1,Set 2", strings.Join(titles, ","))
+}
+
+func TestPhotosetsWrite(t *testing.T) {
+	var calls []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "http method", "POST", r.Method)
+		assertEq(t, "query", "", r.URL.RawQuery)
+		assertOK(t, "ParseForm", r.ParseForm())
+		f := r.PostForm
+		call := f.Get("method")
+		for _, k := range []string{"photoset_id", "photo_id", "photo_ids", "photoset_ids",
+			"primary_photo_id", "title", "description"} {
+			if v := f.Get(k); v != "" {
+				call += " " + k + "=" + v
+			}
+		}
+		calls = append(calls, call)
+		if f.Get("method") == "flickr.photosets.create" {
+			return xmlResponse(`<rsp stat="ok">
+              <photoset id="1234" url="http://www.flickr.com/photos/bees/sets/1234/" />
+            </rsp>`)()
+		}
+		if f.Get("photo_id") == "3" {
+			return xmlResponse(`<rsp stat="fail"><err code="3" msg="Photo already in set" /></rsp>`)()
+		}
+		return xmlResponse(`<rsp stat="ok" />`)()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn)).WithUser(Credentials{Token: "t", Secret: "s"})
+	c.RateLimiter = nil
+
+	s, err := c.PhotosetsCreate(PhotosetsCreateParams{Title: "Trip", PrimaryPhotoID: "1"})
+	assertOK(t, "create", err)
+	assertEq(t, "id", "1234", s.ID)
+	assertEq(t, "url", "http://www.flickr.com/photos/bees/sets/1234/", s.URL)
+	assertOK(t, "editMeta", c.PhotosetsEditMeta(PhotosetsEditMetaParams{
+		PhotosetID: "1234", Title: "Trip 2", Description: "Fun"}))
+	assertOK(t, "editPhotos", c.PhotosetsEditPhotos(PhotosetsEditPhotosParams{
+		PhotosetID: "1234", PrimaryPhotoID: "2", PhotoIDs: []string{"1", "2"}}))
+	assertOK(t, "addPhoto", c.PhotosetsAddPhoto(PhotosetsAddPhotoParams{PhotosetID: "1234", PhotoID: "4"}))
+	err = c.PhotosetsAddPhoto(PhotosetsAddPhotoParams{PhotosetID: "1234", PhotoID: "3"})
+	assert(t, "already in set", errors.Is(err, &APIError{Code: ErrCodePhotoAlreadyInSet}))
+	assertOK(t, "removePhoto", c.PhotosetsRemovePhoto(PhotosetsRemovePhotoParams{PhotosetID: "1234", PhotoID: "4"}))
+	assertOK(t, "removePhotos", c.PhotosetsRemovePhotos(PhotosetsRemovePhotosParams{
+		PhotosetID: "1234", PhotoIDs: []string{"1", "4"}}))
+	assertOK(t, "reorderPhotos", c.PhotosetsReorderPhotos(PhotosetsReorderPhotosParams{
+		PhotosetID: "1234", PhotoIDs: []string{"2", "1"}}))
+	assertOK(t, "setPrimaryPhoto", c.PhotosetsSetPrimaryPhoto(PhotosetsSetPrimaryPhotoParams{
+		PhotosetID: "1234", PhotoID: "1"}))
+	assertOK(t, "orderSets", c.PhotosetsOrderSets(PhotosetsOrderSetsParams{PhotosetIDs: []string{"1234", "5"}}))
+	assertOK(t, "delete", c.PhotosetsDelete(PhotosetsDeleteParams{PhotosetID: "1234"}))
+
+	expected := []string{
+		"flickr.photosets.create primary_photo_id=1 title=Trip",
+		"flickr.photosets.editMeta photoset_id=1234 title=Trip 2 description=Fun",
+		"flickr.photosets.editPhotos photoset_id=1234 photo_ids=1,2 primary_photo_id=2",
+		"flickr.photosets.addPhoto photoset_id=1234 photo_id=4",
+		"flickr.photosets.addPhoto photoset_id=1234 photo_id=3",
+		"flickr.photosets.removePhoto photoset_id=1234 photo_id=4",
+		"flickr.photosets.removePhotos photoset_id=1234 photo_ids=1,4",
+		"flickr.photosets.reorderPhotos photoset_id=1234 photo_ids=2,1",
+		"flickr.photosets.setPrimaryPhoto photoset_id=1234 photo_id=1",
+		"flickr.photosets.orderSets photoset_ids=1234,5",
+		"flickr.photosets.delete photoset_id=1234",
+	}
+	assertEq(t, "calls", strings.Join(expected, "\n"), strings.Join(calls, "\n"))
+}
+
+func TestPhotosetsWriteJSON(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertOK(t, "ParseForm", r.ParseForm())
+		assertEq(t, "format", "json", r.PostForm.Get("format"))
+		return xmlResponse(`{"photoset":{"id":"1234","url":"http://www.flickr.com/photos/bees/sets/1234/"},"stat":"ok"}`)()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.Format = FormatJSON
+	s, err := c.PhotosetsCreate(PhotosetsCreateParams{Title: "Trip", PrimaryPhotoID: "1"})
+	assertOK(t, "create", err)
+	assertEq(t, "id", "1234", s.ID)
+}
+
 func TestGetPeopleInfo(t *testing.T) {
 	xmlStr := `<?xml version="1.0" encoding="utf-8" ?>
     <rsp stat="ok">
@@ -544,20 +1517,16 @@ func TestGetPeopleInfo(t *testing.T) {
 	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
 	body := fakeBody{data: xmlBytes}
 	currentBody = body
-	resp := http.Response{Body: body}
+	resp := http.Response{StatusCode: http.StatusOK, Body: body}
 
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
-	authToken := "ase878723623"
-	c.AuthToken = authToken
+	c := New(apiKey, secret, newHTTPClient(getFn)).WithUser(Credentials{
+		Token: "ase878723623",
+	})
 
-	userID := "43554602@N02"
-	args := map[string]string{
-		"user_id": userID,
-	}
-	r, err := c.GetPeopleInfo(args)
+	r, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "43554602@N02"})
 
 	assertOK(t, "GetPeopleInfo", err)
 	verify := func(set PersonResponse, idx string, username string) {
@@ -589,14 +1558,14 @@ func TestGetLocation(t *testing.T) {
 	xmlBytes := bytes.NewBufferString(xmlStr).Bytes()
 	body := fakeBody{data: xmlBytes}
 	currentBody = body
-	resp := http.Response{Body: body}
+	resp := http.Response{StatusCode: http.StatusOK, Body: body}
 
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
-	authToken := "ase878723623"
-	c.AuthToken = authToken
+	c := New(apiKey, secret, newHTTPClient(getFn)).WithUser(Credentials{
+		Token: "ase878723623",
+	})
 
 	photoID := "17134823816"
 	args := map[string]string{
@@ -612,3 +1581,1419 @@ func TestGetLocation(t *testing.T) {
 	}
 	verify(*r, 17134823816, "40.730892", "-73.997475")
 }
+
+// -----------------------
+// Tests for credentials.go
+func testTokenStore(t *testing.T, name string, s TokenStore) {
+	_, err := s.Get("alice")
+	assertEq(t, name+".missing", ErrNoCredentials, err)
+
+	alice := Credentials{Token: "t1", Secret: "s1", NSID: "1@N01", Perms: WritePerm}
+	assertOK(t, name+".put", s.Put("alice", alice))
+	assertOK(t, name+".put", s.Put("bob", Credentials{Token: "t2", Secret: "s2"}))
+	got, err := s.Get("alice")
+	assertOK(t, name+".get", err)
+	assertEq(t, name+".get", alice, got)
+
+	alice.Perms = DeletePerm
+	assertOK(t, name+".replace", s.Put("alice", alice))
+	got, err = s.Get("alice")
+	assertOK(t, name+".get replaced", err)
+	assertEq(t, name+".get replaced", DeletePerm, got.Perms)
+
+	assertOK(t, name+".delete", s.Delete("alice"))
+	assertOK(t, name+".delete missing", s.Delete("alice"))
+	_, err = s.Get("alice")
+	assertEq(t, name+".deleted", ErrNoCredentials, err)
+	got, err = s.Get("bob")
+	assertOK(t, name+".get other", err)
+	assertEq(t, name+".get other", "t2", got.Token)
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	testTokenStore(t, "memory", NewMemoryTokenStore())
+}
+
+func TestFileTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flickgo")
+	assertOK(t, "TempDir", err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+	testTokenStore(t, "file", NewFileTokenStore(path))
+
+	// A second store on the same file sees the same data.
+	got, err := NewFileTokenStore(path).Get("bob")
+	assertOK(t, "reopen", err)
+	assertEq(t, "reopen", "s2", got.Secret)
+
+	assertOK(t, "corrupt", ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = NewFileTokenStore(path).Get("bob")
+	assert(t, "corrupt", err != nil && err != ErrNoCredentials)
+}
+
+// -----------------------
+// Tests for errors.go
+func TestAPIError(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8" ?>
+    <rsp stat="fail">
+      <err code="1" msg="User not found" />
+    </rsp>`
+	currentBody = fakeBody{data: []byte(xmlStr)}
+	resp := http.Response{StatusCode: http.StatusOK, Body: currentBody}
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &resp, nil
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	_, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+
+	var apiErr *APIError
+	assert(t, "errors.As", errors.As(err, &apiErr))
+	assertEq(t, "method", "flickr.people.getInfo", apiErr.Method)
+	assertEq(t, "code", ErrCodeNotFound, apiErr.Code)
+	assertEq(t, "message", "User not found", apiErr.Message)
+	assertEq(t, "error", "flickr.people.getInfo: Flickr error code 1: User not found", err.Error())
+	assert(t, "IsNotFound", IsNotFound(err))
+	assert(t, "IsAuthError", !IsAuthError(err))
+	assert(t, "IsRetryable", !IsRetryable(err))
+	assert(t, "errors.Is code", errors.Is(err, &APIError{Code: ErrCodeNotFound}))
+	assert(t, "errors.Is method",
+		errors.Is(err, &APIError{Method: "flickr.people.getInfo", Code: ErrCodeNotFound}))
+	assert(t, "errors.Is other method",
+		!errors.Is(err, &APIError{Method: "flickr.photos.getInfo", Code: ErrCodeNotFound}))
+	assert(t, "errors.Is other code", !errors.Is(err, &APIError{Code: ErrCodeInvalidAPIKey}))
+}
+
+func TestAPIErrorHelpers(t *testing.T) {
+	wrapped := func(code int, msg string) error {
+		return fmt.Errorf("wrapped: %w", &APIError{Method: "m", Code: code, Message: msg})
+	}
+	assert(t, "not found", IsNotFound(wrapped(ErrCodeNotFound, "Photo not found")))
+	assert(t, "not found, other message", IsNotFound(wrapped(ErrCodeNotFound, "Unknown photo")))
+	assert(t, "code 2", !IsNotFound(wrapped(2, "Invalid extras")))
+	methodErr := func(method string, code int) error {
+		return &APIError{Method: method, Code: code}
+	}
+	assert(t, "search code 1", !IsNotFound(methodErr("flickr.photos.search", 1)))
+	assert(t, "search code 2", IsNotFound(methodErr("flickr.photos.search", 2)))
+	assert(t, "addPhoto code 2", IsNotFound(methodErr("flickr.photosets.addPhoto", 2)))
+	assert(t, "addPhoto code 3", !IsNotFound(methodErr("flickr.photosets.addPhoto", 3)))
+	assert(t, "upload code 1", !IsNotFound(methodErr("upload", 1)))
+	for _, code := range []int{96, 97, 98, 99, 100} {
+		assert(t, fmt.Sprintf("auth %d", code), IsAuthError(wrapped(code, "")))
+	}
+	assert(t, "auth 105", !IsAuthError(wrapped(105, "")))
+	assert(t, "retryable 105", IsRetryable(wrapped(ErrCodeServiceUnavailable, "")))
+	assert(t, "retryable 106", IsRetryable(wrapped(ErrCodeWriteFailed, "")))
+	assert(t, "retryable 100", !IsRetryable(wrapped(ErrCodeInvalidAPIKey, "")))
+	assert(t, "plain error", !IsRetryable(errors.New("x")) && !IsAuthError(nil))
+	assertEq(t, "no method", "Flickr error code 2: x", (&APIError{Code: 2, Message: "x"}).Error())
+}
+
+// -----------------------
+// Tests for retry.go
+type testLogger struct {
+	lines []string
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+// Returns an HTTP client that serves the given responses in turn, and a
+// pointer to the number of requests made.
+func newSequenceClient(t *testing.T, responses ...func() (*http.Response, error)) (*http.Client, *int) {
+	n := 0
+	getFn := func(r *http.Request) (*http.Response, error) {
+		if n >= len(responses) {
+			t.Errorf("unexpected request %d", n+1)
+			return nil, errors.New("unexpected request")
+		}
+		n++
+		return responses[n-1]()
+	}
+	return newHTTPClient(getFn), &n
+}
+
+func xmlResponse(xmlStr string) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(xmlStr)),
+		}, nil
+	}
+}
+
+func statusResponse(code int) func() (*http.Response, error) {
+	return func() (*http.Response, error) {
+		return &http.Response{
+			StatusCode: code,
+			Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+}
+
+const personXML = `<rsp stat="ok"><person id="1@N01" nsid="1@N01"><username>u</username></person></rsp>`
+
+func TestRetryReadMethod(t *testing.T) {
+	httpClient, n := newSequenceClient(t,
+		statusResponse(http.StatusServiceUnavailable),
+		xmlResponse(`<rsp stat="fail"><err code="105" msg="Service currently unavailable" /></rsp>`),
+		xmlResponse(personXML))
+	c := New(apiKey, secret, httpClient)
+	logger := &testLogger{}
+	c.Logger = logger
+	c.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	p, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	assertOK(t, "PeopleGetInfo", err)
+	assertEq(t, "attempts", 3, *n)
+	assertEq(t, "username", "u", p.UserName)
+	retries := 0
+	for _, l := range logger.lines {
+		if strings.Contains(l, "flickr.people.getInfo: attempt") {
+			retries++
+		}
+	}
+	assertEq(t, "logged retries", 2, retries)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	httpClient, n := newSequenceClient(t,
+		statusResponse(http.StatusBadGateway),
+		statusResponse(http.StatusBadGateway))
+	c := New(apiKey, secret, httpClient)
+	c.Retry = &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+
+	_, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	var h *HTTPError
+	assert(t, "HTTPError", errors.As(err, &h))
+	assertEq(t, "attempts", 2, *n)
+}
+
+func TestRetryNotRetryable(t *testing.T) {
+	httpClient, n := newSequenceClient(t,
+		xmlResponse(`<rsp stat="fail"><err code="1" msg="User not found" /></rsp>`))
+	c := New(apiKey, secret, httpClient)
+	c.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	_, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	assert(t, "IsNotFound", IsNotFound(err))
+	assertEq(t, "attempts", 1, *n)
+}
+
+func TestRetryWriteMethod(t *testing.T) {
+	httpClient, n := newSequenceClient(t,
+		statusResponse(http.StatusServiceUnavailable),
+		statusResponse(http.StatusServiceUnavailable),
+		xmlResponse(`<rsp stat="ok" />`))
+	c := New(apiKey, secret, httpClient)
+	c.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	err := c.PushSubscribe(map[string]string{})
+	assert(t, "not retried by default", err != nil)
+	assertEq(t, "attempts", 1, *n)
+
+	c.Retry.Methods = map[string]bool{"flickr.push.subscribe": true}
+	assertOK(t, "retried when enabled", c.PushSubscribe(map[string]string{}))
+	assertEq(t, "attempts", 3, *n)
+}
+
+func TestRetryCancelled(t *testing.T) {
+	httpClient, n := newSequenceClient(t, statusResponse(http.StatusServiceUnavailable))
+	c := New(apiKey, secret, httpClient)
+	c.Retry = &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.PeopleGetInfoContext(ctx, PeopleGetInfoParams{UserID: "1@N01"})
+	assertEq(t, "err", context.DeadlineExceeded, err)
+	assertEq(t, "attempts", 1, *n)
+}
+
+func TestRetryTransportError(t *testing.T) {
+	var nonces []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		nonces = append(nonces, r.URL.Query().Get("oauth_nonce"))
+		if len(nonces) == 1 {
+			return nil, errors.New("connection reset by peer")
+		}
+		return xmlResponse(personXML)()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = nil
+	c.Retry = &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+
+	_, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	assertOK(t, "PeopleGetInfo", err)
+	assertEq(t, "attempts", 2, len(nonces))
+	assert(t, "fresh nonce", nonces[0] != nonces[1])
+
+	// Writes may have reached Flickr before the connection failed.
+	nonces = nil
+	assert(t, "write", c.PushSubscribe(map[string]string{}) != nil)
+	assertEq(t, "write attempts", 1, len(nonces))
+}
+
+func TestRetryPost(t *testing.T) {
+	var nonces []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		r.ParseForm()
+		nonces = append(nonces, r.PostForm.Get("oauth_nonce"))
+		if len(nonces) == 1 {
+			return statusResponse(http.StatusInternalServerError)()
+		}
+		return xmlResponse(`<rsp stat="ok" />`)()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = nil
+	c.Retry = &RetryPolicy{
+		MaxAttempts: 2,
+		BaseDelay:   time.Millisecond,
+		Methods:     map[string]bool{"test": true},
+	}
+	r := struct{ apiStatus }{}
+	assertOK(t, "flickrPostForm", flickrPostForm(context.Background(), c, "test", nil, &r))
+	assertEq(t, "attempts", 2, len(nonces))
+	assert(t, "nonce", nonces[0] != "")
+	assert(t, "signed again", nonces[0] != nonces[1])
+
+	// Requests that cannot be replayed are sent once.
+	nonces = nil
+	newRequest := func() (*http.Request, error) {
+		return postRequest(c, "test", nil)
+	}
+	assert(t, "not replayable",
+		flickrPost(context.Background(), c, "test", false, newRequest, FormatXML, &r) != nil)
+	assertEq(t, "attempts when not replayable", 1, len(nonces))
+}
+
+func TestRetryPolicyRetries(t *testing.T) {
+	p := DefaultRetryPolicy()
+	for _, m := range []string{"flickr.photos.search", "flickr.people.getInfo",
+		"flickr.photos.upload.checkTickets", "flickr.urls.lookupUser"} {
+		assert(t, m, p.retries(m))
+	}
+	for _, m := range []string{"flickr.photosets.addPhoto", "flickr.push.subscribe",
+		"flickr.auth.oauth.getAccessToken", "upload", ""} {
+		assert(t, m, !p.retries(m))
+	}
+	p.Methods = map[string]bool{"upload": true, "flickr.photos.search": false}
+	assert(t, "override upload", p.retries("upload"))
+	assert(t, "override search", !p.retries("flickr.photos.search"))
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	between := func(tag string, d, lo, hi time.Duration) {
+		assert(t, fmt.Sprintf("%s: %v in [%v, %v]", tag, d, lo, hi), lo <= d && d <= hi)
+	}
+	for i := 0; i < 20; i++ {
+		between("attempt 1", p.delay(1, errors.New("x")), 50*time.Millisecond, 100*time.Millisecond)
+		between("attempt 3", p.delay(3, errors.New("x")), 200*time.Millisecond, 400*time.Millisecond)
+		between("capped", p.delay(10, errors.New("x")), 500*time.Millisecond, time.Second)
+	}
+	retryAfter := &HTTPError{StatusCode: 503, RetryAfter: 5 * time.Second}
+	assertEq(t, "retry-after", 5*time.Second, p.delay(1, retryAfter))
+}
+
+// -----------------------
+// Tests for ratelimit.go
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewTokenBucket(2, 3)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		assertEq(t, fmt.Sprintf("burst %d", i), time.Duration(0), b.reserve())
+	}
+	assertEq(t, "empty", 500*time.Millisecond, b.reserve())
+	assertEq(t, "queued", time.Second, b.reserve())
+
+	// Tokens accumulate over time, but never beyond the burst size.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assertEq(t, fmt.Sprintf("refilled %d", i), time.Duration(0), b.reserve())
+	}
+	assertEq(t, "refill capped", 500*time.Millisecond, b.reserve())
+	b.cancel()
+	assertEq(t, "cancelled reservation returned", 500*time.Millisecond, b.reserve())
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := NewTokenBucket(1000, 1)
+	assertOK(t, "first", b.Wait(context.Background()))
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assertOK(t, "wait", b.Wait(context.Background()))
+	}
+	assert(t, "waited", time.Since(start) >= 4*time.Millisecond)
+
+	b = NewTokenBucket(0.001, 1)
+	assertOK(t, "first", b.Wait(context.Background()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assertEq(t, "cancelled", context.DeadlineExceeded, b.Wait(ctx))
+	cancelled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	assertEq(t, "already cancelled", context.Canceled, b.Wait(cancelled))
+}
+
+func TestTokenBucketInvalidRate(t *testing.T) {
+	for _, rate := range []float64{0, -1, math.NaN()} {
+		func() {
+			defer func() {
+				assert(t, fmt.Sprintf("rate %v panics", rate), recover() != nil)
+			}()
+			NewTokenBucket(rate, 1)
+		}()
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	assert(t, "same key", SharedRateLimiter("k1") == SharedRateLimiter("k1"))
+	assert(t, "different key", SharedRateLimiter("k1") != SharedRateLimiter("k2"))
+	c1 := New("k1", secret, nil)
+	c2 := New("k1", secret, nil)
+	assert(t, "New does not share", c1.RateLimiter != c2.RateLimiter)
+}
+
+func TestQuotaCounter(t *testing.T) {
+	q := &quotaCounter{}
+	start := time.Unix(1000*60, 0)
+	for i := 0; i < 90; i++ {
+		q.add(start.Add(time.Duration(i) * time.Minute))
+	}
+	q.add(start.Add(89 * time.Minute))
+	assertEq(t, "last hour", 61, q.used(start.Add(89*time.Minute)))
+	assertEq(t, "later", 31, q.used(start.Add(119*time.Minute)))
+	assertEq(t, "much later", 0, q.used(start.Add(200*time.Minute)))
+}
+
+// -----------------------
+// Tests for json.go
+//
+// Calls fn with a client serving xmlStr and with one serving jsonStr in
+// FormatJSON, and checks that both calls return the same values.
+func assertSameDecoding(t *testing.T, id string, xmlStr string, jsonStr string,
+	fn func(c *Client) (interface{}, error)) {
+	var formats []string
+	serve := func(body string) *http.Client {
+		return newHTTPClient(func(r *http.Request) (*http.Response, error) {
+			q := r.URL.Query()
+			formats = append(formats, q.Get("format")+"/"+q.Get("nojsoncallback"))
+			return xmlResponse(body)()
+		})
+	}
+	fromXML, xErr := fn(New(apiKey, secret, serve(xmlStr)))
+	jc := New(apiKey, secret, serve(jsonStr))
+	jc.Format = FormatJSON
+	fromJSON, jErr := fn(jc)
+
+	assertEq(t, id+".formats", "/json/1", strings.Join(formats, ""))
+	if xErr != nil || jErr != nil {
+		assertEq(t, id+".err", fmt.Sprint(xErr), fmt.Sprint(jErr))
+		return
+	}
+	if !reflect.DeepEqual(fromXML, fromJSON) {
+		t.Errorf("[%s] XML and JSON decode differently:\n%#v\n%#v", id, fromXML, fromJSON)
+	}
+}
+
+func TestJSONSearch(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <photos page="1" pages="3" perpage="2" total="5">
+        <photo id="1234" owner="22@N01" secret="63562" server="3" farm="1"
+            title="kitten" ispublic="0" width_t="100" height_t="100"/>
+        <photo id="5678" owner="22@N01" secret="36221" server="32" farm="4"
+            title="puppies &amp; more" ispublic="1" width_t="120" height_t="100"/>
+      </photos>
+    </rsp>`
+	jsonStr := `{"photos":{"page":1,"pages":"3","perpage":2,"total":"5","photo":[
+        {"id":"1234","owner":"22@N01","secret":"63562","server":"3","farm":1,
+         "title":"kitten","ispublic":0,"width_t":100,"height_t":"100"},
+        {"id":"5678","owner":"22@N01","secret":"36221","server":"32","farm":4,
+         "title":"puppies & more","ispublic":1,"width_t":"120","height_t":100}]},
+      "stat":"ok"}`
+	assertSameDecoding(t, "search", xmlStr, jsonStr, func(c *Client) (interface{}, error) {
+		return c.PhotosSearch(PhotosSearchParams{})
+	})
+}
+
+func TestJSONPhotoInfo(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <photo id="2733" secret="123456" server="12" farm="1" isfavorite="0"
+          license="3" rotation="90" views="42" media="photo">
+        <owner nsid="12037949754@N01" username="Bees" realname="Cal Henderson"
+            location="Bedford, UK" iconserver="1" iconfarm="1" path_alias="bees" />
+        <title>orford_castle_taster</title>
+        <description>hello!</description>
+        <tags>
+          <tag id="1234" author="12037949754@N01" raw="woo yay">wooyay</tag>
+          <tag id="1235" author="12037949754@N01" raw="hoopla">hoopla</tag>
+        </tags>
+      </photo>
+    </rsp>`
+	jsonStr := `{"photo":{"id":"2733","secret":"123456","server":"12","farm":1,
+        "isfavorite":0,"license":"3","rotation":90,"views":"42","media":"photo",
+        "owner":{"nsid":"12037949754@N01","username":"Bees","realname":"Cal Henderson",
+          "location":"Bedford, UK","iconserver":"1","iconfarm":1,"path_alias":"bees"},
+        "title":{"_content":"orford_castle_taster"},
+        "description":{"_content":"hello!"},
+        "tags":{"tag":[
+          {"id":"1234","author":"12037949754@N01","raw":"woo yay","_content":"wooyay"},
+          {"id":"1235","author":"12037949754@N01","raw":"hoopla","_content":"hoopla"}]}},
+      "stat":"ok"}`
+	assertSameDecoding(t, "photoinfo", xmlStr, jsonStr, func(c *Client) (interface{}, error) {
+		return c.PhotosGetInfo(PhotosGetInfoParams{PhotoID: "2733"})
+	})
+}
+
+func TestJSONPerson(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <person id="88629109@N00" nsid="88629109@N00" ispro="1" iconserver="10"
+          iconfarm="1" path_alias="ceonyc" gender="M">
+        <username>ceonyc</username>
+      </person>
+    </rsp>`
+	jsonStr := `{"person":{"id":"88629109@N00","nsid":"88629109@N00","ispro":1,
+        "iconserver":"10","iconfarm":1,"path_alias":"ceonyc","gender":"M",
+        "username":{"_content":"ceonyc"}},"stat":"ok"}`
+	assertSameDecoding(t, "person", xmlStr, jsonStr, func(c *Client) (interface{}, error) {
+		return c.PeopleGetInfo(PeopleGetInfoParams{UserID: "88629109@N00"})
+	})
+}
+
+func TestJSONLocation(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <photo id="17134823816">
+        <location latitude="40.730892" longitude="-73.997475" accuracy="16"
+            context="0" place_id="C519PWNTVru_efdS" woeid="2414665" />
+      </photo>
+    </rsp>`
+	jsonStr := `{"photo":{"id":"17134823816","location":{"latitude":"40.730892",
+        "longitude":"-73.997475","accuracy":"16","context":0,
+        "place_id":"C519PWNTVru_efdS","woeid":"2414665"}},"stat":"ok"}`
+	assertSameDecoding(t, "location", xmlStr, jsonStr, func(c *Client) (interface{}, error) {
+		return c.GetLocation(map[string]string{"photo_id": "17134823816"})
+	})
+}
+
+func TestJSONError(t *testing.T) {
+	xmlStr := `<rsp stat="fail"><err code="1" msg="User not found" /></rsp>`
+	jsonStr := `{"stat":"fail","code":1,"message":"User not found"}`
+	assertSameDecoding(t, "error", xmlStr, jsonStr, func(c *Client) (interface{}, error) {
+		return c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	})
+
+	httpClient, _ := newSequenceClient(t, xmlResponse(jsonStr))
+	c := New(apiKey, secret, httpClient)
+	c.Format = FormatJSON
+	_, err := c.PeopleGetInfo(PeopleGetInfoParams{UserID: "1@N01"})
+	assert(t, "IsNotFound", IsNotFound(err))
+}
+
+func TestJSONPhotosetPhotos(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <photoset id="4" primary="2483" owner="12@N01" ownername="Bees"
+          title="Test" page="1" pages="1" perpage="500" total="2">
+        <photo id="2484" secret="123456" server="1" farm="1" title="my photo" isprimary="0"/>
+        <photo id="2483" secret="123456" server="1" farm="1" title="flickr rocks" isprimary="1"/>
+      </photoset>
+    </rsp>`
+	jsonStr := `{"photoset":{"id":"4","primary":"2483","owner":"12@N01","ownername":"Bees",
+        "title":"Test","page":1,"pages":"1","perpage":500,"total":"2","photo":[
+        {"id":"2484","secret":"123456","server":"1","farm":1,"title":"my photo","isprimary":"0"},
+        {"id":"2483","secret":"123456","server":"1","farm":1,"title":"flickr rocks","isprimary":"1"}]},
+      "stat":"ok"}`
+	assertSameDecoding(t, "photosetphotos", xmlStr, jsonStr, func(c *Client) (interface{}, error) {
+		return c.PhotosetsGetPhotos(PhotosetsGetPhotosParams{PhotosetID: "4"})
+	})
+}
+
+func TestJSONPhotosetInfo(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <photoset id="4" owner="12@N01" primary="2483" photos="2"
+          date_create="1280530593" date_update="0">
+        <title>Test</title>
+        <description>foo</description>
+      </photoset>
+    </rsp>`
+	jsonStr := `{"photoset":{"id":"4","owner":"12@N01","primary":"2483","photos":2,
+        "date_create":"1280530593","date_update":"0",
+        "title":{"_content":"Test"},"description":{"_content":"foo"}},"stat":"ok"}`
+	assertSameDecoding(t, "photosetinfo", xmlStr, jsonStr, func(c *Client) (interface{}, error) {
+		return c.PhotosetsGetInfo(PhotosetsGetInfoParams{PhotosetID: "4"})
+	})
+}
+
+func TestDecodeJSONP(t *testing.T) {
+	r := struct {
+		apiStatus
+		Person PersonResponse `xml:"person"`
+	}{}
+	err := decodeJSON([]byte(` jsonFlickrApi({"person":{"id":"1@N01"},"stat":"ok"})`), &r)
+	assertOK(t, "decodeJSON", err)
+	assertEq(t, "stat", "ok", r.Stat)
+	assertEq(t, "id", "1@N01", r.Person.ID)
+
+	err = decodeJSON([]byte(`{"photos":{"page":"x"},"stat":"ok"}`), &struct {
+		apiStatus
+		Photos SearchResponse `xml:"photos"`
+	}{})
+	assert(t, "bad number", err != nil)
+}
+
+// -----------------------
+// Tests for bulk.go
+//
+// Stand-in for Flickr's upload endpoint and photoset methods.  Uploads of
+// files whose content starts with "flaky" fail once with HTTP 503.  Uploads
+// of files whose content starts with "lost" are stored, but the connection
+// drops before the first response for each file is sent.
+type fakeUploadServer struct {
+	mu       sync.Mutex
+	uploads  []string
+	methods  []string
+	failed   map[string]bool
+	nextID   int
+	created  string
+	setPhoto []string
+
+	// IDs of uploaded photos by the tags they were uploaded with.
+	tagged map[string]string
+
+	// Number of searches a new tag is hidden from, like Flickr adding new
+	// photos to search with a delay, and the searches left by tag.
+	searchDelay int
+	hidden      map[string]int
+}
+
+func (s *fakeUploadServer) roundTrip(r *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/services/upload" {
+		if err := r.ParseMultipartForm(1024); err != nil {
+			return nil, err
+		}
+		f, _ := r.MultipartForm.File["photo"][0].Open()
+		data, _ := ioutil.ReadAll(f)
+		content := string(data[4:])
+		if strings.HasPrefix(content, "flaky") && !s.failed[content] {
+			s.failed[content] = true
+			return statusResponse(http.StatusServiceUnavailable)()
+		}
+		s.uploads = append(s.uploads, content)
+		s.nextID++
+		for _, tag := range strings.Fields(r.FormValue("tags")) {
+			s.tagged[tag] = strconv.Itoa(s.nextID)
+			if s.searchDelay > 0 {
+				s.hidden[tag] = s.searchDelay
+			}
+		}
+		if strings.HasPrefix(content, "lost") && !s.failed[content] {
+			s.failed[content] = true
+			return nil, errors.New("connection reset by peer")
+		}
+		return xmlResponse(fmt.Sprintf(`<rsp stat="ok"><photoid>%d</photoid></rsp>`, s.nextID))()
+	}
+	q := r.URL.Query()
+	method := q.Get("method")
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		q = r.PostForm
+		method = q.Get("method")
+	}
+	s.methods = append(s.methods, method)
+	if strings.HasPrefix(method, "flickr.photosets.") && method != "flickr.photosets.getList" &&
+		r.Method != "POST" {
+		return statusResponse(http.StatusMethodNotAllowed)()
+	}
+	switch method {
+	case "flickr.photosets.getList":
+		return xmlResponse(`<rsp stat="ok"><photosets page="1" pages="1">
+            <photoset id="1"><title>Other</title></photoset>` + s.created + `
+            </photosets></rsp>`)()
+	case "flickr.photosets.create":
+		s.created = `<photoset id="72"><title>` + q.Get("title") + `</title></photoset>`
+		s.setPhoto = append(s.setPhoto, q.Get("primary_photo_id"))
+		return xmlResponse(`<rsp stat="ok"><photoset id="72" /></rsp>`)()
+	case "flickr.photos.search":
+		photos := ""
+		tag := q.Get("machine_tags")
+		if s.hidden[tag] > 0 {
+			s.hidden[tag]--
+		} else if id, ok := s.tagged[tag]; ok && q.Get("user_id") == "me" {
+			photos = `<photo id="` + id + `" />`
+		}
+		return xmlResponse(`<rsp stat="ok"><photos>` + photos + `</photos></rsp>`)()
+	case "flickr.photosets.addPhoto":
+		s.setPhoto = append(s.setPhoto, q.Get("photo_id"))
+		return xmlResponse(`<rsp stat="ok" />`)()
+	}
+	return statusResponse(http.StatusNotFound)()
+}
+
+func TestBulkUploader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flickgo")
+	assertOK(t, "TempDir", err)
+	defer os.RemoveAll(dir)
+	var paths []string
+	for _, content := range []string{"a", "flaky b", "c", "d"} {
+		p := filepath.Join(dir, strings.Replace(content, " ", "_", -1)+".jpg")
+		assertOK(t, "WriteFile", ioutil.WriteFile(p, []byte("\xff\xd8\xff\xe0"+content), 0600))
+		paths = append(paths, p)
+	}
+	paths = append(paths, filepath.Join(dir, "missing.jpg"))
+
+	srv := &fakeUploadServer{failed: make(map[string]bool), tagged: make(map[string]string)}
+	c := New(apiKey, secret, newHTTPClient(srv.roundTrip))
+	c.RateLimiter = nil
+	u := &BulkUploader{
+		Client:      c,
+		Workers:     2,
+		RetryDelay:  time.Millisecond,
+		JournalPath: filepath.Join(dir, "journal"),
+		Photoset:    "Event",
+	}
+	report, err := u.Run(paths[:2])
+	assertOK(t, "Run", err)
+	assertEq(t, "failed", 0, len(report.Failed()))
+	assertEq(t, "uploads", 2, len(srv.uploads))
+	assert(t, "flaky retried", srv.failed["flaky b"])
+
+	// The second run resumes the first: only new files are uploaded.
+	var done []string
+	var doneMu sync.Mutex
+	u.Done = func(r BulkResult) {
+		doneMu.Lock()
+		defer doneMu.Unlock()
+		done = append(done, filepath.Base(r.Path))
+	}
+	report, err = u.Run(paths)
+	assertOK(t, "Run", err)
+	assertEq(t, "uploads", 4, len(srv.uploads))
+	assertEq(t, "done", 5, len(done))
+	assertEq(t, "results", 5, len(report.Results))
+	for i, r := range report.Results {
+		assertEq(t, fmt.Sprintf("%d.path", i), paths[i], r.Path)
+		assertEq(t, fmt.Sprintf("%d.resumed", i), i < 2, r.Resumed)
+	}
+	failed := report.Failed()
+	assertEq(t, "failed", 1, len(failed))
+	assertEq(t, "failed path", paths[4], failed[0].Path)
+	assert(t, "not exist", os.IsNotExist(errors.Unwrap(failed[0].Err)) || os.IsNotExist(failed[0].Err))
+	ids := report.PhotoIDs()
+	assertEq(t, "ids", 4, len(ids))
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		seen[id] = true
+	}
+	assertEq(t, "distinct ids", 4, len(seen))
+
+	// The set is created once, then looked up once per run.
+	sort.Strings(srv.setPhoto)
+	assertEq(t, "set photos", "1 2 3 4", strings.Join(srv.setPhoto, " "))
+	creates := 0
+	for _, m := range srv.methods {
+		if m == "flickr.photosets.create" {
+			creates++
+		}
+	}
+	assertEq(t, "creates", 1, creates)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	u.JournalPath = ""
+	report, err = u.RunContext(ctx, paths)
+	assertOK(t, "cancelled run", err)
+	assertEq(t, "cancelled", len(paths), len(report.Failed()))
+	assertEq(t, "cancelled uploads", 4, len(srv.uploads))
+}
+
+func TestChecksumTag(t *testing.T) {
+	tag, err := ChecksumTag(strings.NewReader("abc"))
+	assertOK(t, "ChecksumTag", err)
+	assertEq(t, "tag",
+		"checksum:sha256=ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", tag)
+}
+
+func TestBulkUploaderSkipDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flickgo")
+	assertOK(t, "TempDir", err)
+	defer os.RemoveAll(dir)
+	var paths []string
+	for i, content := range []string{"a", "b", "a"} {
+		p := filepath.Join(dir, fmt.Sprintf("%d.jpg", i))
+		assertOK(t, "WriteFile", ioutil.WriteFile(p, []byte("\xff\xd8\xff\xe0"+content), 0600))
+		paths = append(paths, p)
+	}
+
+	srv := &fakeUploadServer{failed: make(map[string]bool), tagged: make(map[string]string)}
+	c := New(apiKey, secret, newHTTPClient(srv.roundTrip))
+	c.RateLimiter = nil
+	u := &BulkUploader{
+		Client:         c,
+		Workers:        1,
+		SkipDuplicates: true,
+		Params: func(path string) UploadParams {
+			return UploadParams{Tags: []string{"event"}}
+		},
+	}
+	report, err := u.Run(paths)
+	assertOK(t, "Run", err)
+	assertEq(t, "failed", 0, len(report.Failed()))
+	assertEq(t, "uploads", "a b", strings.Join(srv.uploads, " "))
+	assertEq(t, "duplicate", true, report.Results[2].Duplicate)
+	assertEq(t, "duplicate id", report.Results[0].PhotoID, report.Results[2].PhotoID)
+	assertEq(t, "tagged", 3, len(srv.tagged))
+	assertEq(t, "user tag kept", "2", srv.tagged["event"])
+
+	// Files uploaded by another run are found too.
+	report, err = u.Run(paths[1:2])
+	assertOK(t, "Run", err)
+	assertEq(t, "uploads", 2, len(srv.uploads))
+	assertEq(t, "found", true, report.Results[0].Duplicate)
+}
+
+func TestBulkUploaderLostResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flickgo")
+	assertOK(t, "TempDir", err)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "a.jpg")
+	assertOK(t, "WriteFile", ioutil.WriteFile(p, []byte("\xff\xd8\xff\xe0lost a"), 0600))
+
+	srv := &fakeUploadServer{
+		failed:      make(map[string]bool),
+		tagged:      make(map[string]string),
+		searchDelay: 3,
+		hidden:      make(map[string]int),
+	}
+	c := New(apiKey, secret, newHTTPClient(srv.roundTrip))
+	c.RateLimiter = nil
+	u := &BulkUploader{
+		Client:         c,
+		RetryDelay:     time.Millisecond,
+		SkipDuplicates: true,
+		JournalPath:    filepath.Join(dir, "journal"),
+	}
+
+	// The first attempt may have stored the photo, which search does not
+	// find yet, so it is not retried.
+	report, err := u.Run([]string{p})
+	assertOK(t, "Run", err)
+	assert(t, "failed", report.Results[0].Err != nil)
+	assertEq(t, "uploads", 1, len(srv.uploads))
+	j, err := openJournal(u.JournalPath)
+	assertOK(t, "openJournal", err)
+	_, journaled := j.get(p)
+	j.close()
+	assert(t, "not journaled", !journaled)
+
+	// Once Flickr has indexed the photo, the next run finds it.
+	srv.hidden = make(map[string]int)
+	report, err = u.Run([]string{p})
+	assertOK(t, "Run", err)
+	assertOK(t, "result", report.Results[0].Err)
+	assertEq(t, "duplicate", true, report.Results[0].Duplicate)
+	assertEq(t, "photo id", "1", report.Results[0].PhotoID)
+	assertEq(t, "uploads", 1, len(srv.uploads))
+}
+
+// -----------------------
+// Tests for pager.go
+//
+// Returns a client serving search results from pages, one string of photo IDs
+// per page, and reporting pages as the page count.  Requested page numbers are
+// appended to requested.
+func newPagedSearchClient(t *testing.T, pages []string, pageCount int, requested *[]string) *Client {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		page := r.URL.Query().Get("page")
+		*requested = append(*requested, page)
+		n, _ := strconv.Atoi(page)
+		photos := ""
+		if n >= 1 && n <= len(pages) {
+			for _, id := range strings.Fields(pages[n-1]) {
+				photos += `<photo id="` + id + `" />`
+			}
+		}
+		return xmlResponse(fmt.Sprintf(`<rsp stat="ok"><photos page="%d" pages="%d" perpage="3" total="9">%s</photos></rsp>`,
+			n, pageCount, photos))()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = nil
+	return c
+}
+
+func collectPhotoIDs(p *Pager[Photo]) string {
+	var ids []string
+	for p.Next() {
+		ids = append(ids, p.Item().ID)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestPager(t *testing.T) {
+	var requested []string
+	c := newPagedSearchClient(t, []string{"1 2 3", "3 4 5", "6"}, 3, &requested)
+	p := c.PhotosSearchPager(context.Background(), PhotosSearchParams{PerPage: 3})
+	assertEq(t, "ids", "1 2 3 4 5 6", collectPhotoIDs(p))
+	assertOK(t, "err", p.Err())
+	assertEq(t, "pages", "1 2 3", strings.Join(requested, " "))
+	assert(t, "done", !p.Next())
+
+	// Flickr reports more pages than it returns.
+	requested = nil
+	c = newPagedSearchClient(t, []string{"1 2 3", "4"}, 5, &requested)
+	p = c.PhotosSearchPager(context.Background(), PhotosSearchParams{})
+	assertEq(t, "empty page.ids", "1 2 3 4", collectPhotoIDs(p))
+	assertEq(t, "empty page.pages", "1 2 3", strings.Join(requested, " "))
+
+	requested = nil
+	c = newPagedSearchClient(t, []string{"1 2 3", "4 5 6", "7"}, 3, &requested)
+	p = c.PhotosSearchPager(context.Background(), PhotosSearchParams{})
+	p.MaxItems = 4
+	assertEq(t, "max.ids", "1 2 3 4", collectPhotoIDs(p))
+	assertEq(t, "max.pages", "1 2", strings.Join(requested, " "))
+
+	// A page of items returned already ends the iteration.
+	requested = nil
+	c = newPagedSearchClient(t, []string{"1 2 3", "4 5 6", "4 5 6", "7"}, 4, &requested)
+	p = c.PhotosSearchPager(context.Background(), PhotosSearchParams{PerPage: 3})
+	assertEq(t, "repeated.ids", "1 2 3 4 5 6", collectPhotoIDs(p))
+	assertEq(t, "repeated.pages", "1 2 3", strings.Join(requested, " "))
+}
+
+func TestPagerSearchLimit(t *testing.T) {
+	defer func(l int) { searchResultLimit = l }(searchResultLimit)
+	searchResultLimit = 7
+
+	// Flickr reports 5 pages but returns only the first 7 results.
+	var requested []string
+	c := newPagedSearchClient(t, []string{"1 2 3", "4 5 6", "7 8 9", "10 11 12", "13"}, 5, &requested)
+	p := c.PhotosSearchPager(context.Background(), PhotosSearchParams{PerPage: 3})
+	assertEq(t, "ids", "1 2 3 4 5 6 7 8 9", collectPhotoIDs(p))
+	assertEq(t, "pages", "1 2 3", strings.Join(requested, " "))
+
+	// The default page size is 100.
+	searchResultLimit = 150
+	requested = nil
+	c = newPagedSearchClient(t, []string{"1", "2", "3"}, 3, &requested)
+	p = c.PhotosSearchPager(context.Background(), PhotosSearchParams{})
+	assertEq(t, "default.ids", "1 2", collectPhotoIDs(p))
+	assertEq(t, "default.pages", "1 2", strings.Join(requested, " "))
+
+	searchResultLimit = 4000
+	assertEq(t, "limit", 40, searchPageLimit(0))
+	assertEq(t, "limit 500", 8, searchPageLimit(500))
+	assertEq(t, "limit 300", 14, searchPageLimit(300))
+}
+
+func TestPagerErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var requested []string
+	c := newPagedSearchClient(t, []string{"1 2", "3 4"}, 2, &requested)
+	p := c.PhotosSearchPager(ctx, PhotosSearchParams{})
+	assert(t, "first", p.Next())
+	cancel()
+	var ids []string
+	for p.Next() {
+		ids = append(ids, p.Item().ID)
+	}
+	assertEq(t, "rest of page", "2", strings.Join(ids, " "))
+	assert(t, "cancelled", errors.Is(p.Err(), context.Canceled))
+	assertEq(t, "pages", "1", strings.Join(requested, " "))
+
+	httpClient, _ := newSequenceClient(t,
+		xmlResponse(`<rsp stat="ok"><photo id="1" page="1" pages="2"><person nsid="a" /></photo></rsp>`),
+		xmlResponse(`<rsp stat="fail"><err code="1" msg="Photo not found" /></rsp>`))
+	c = New(apiKey, secret, httpClient)
+	c.RateLimiter = nil
+	fp := c.PhotosGetFavoritesPager(context.Background(), PhotosGetFavoritesParams{PhotoID: "1"})
+	assert(t, "favorite", fp.Next())
+	assertEq(t, "nsid", "a", fp.Item().NSID)
+	assert(t, "failed", !fp.Next())
+	assert(t, "IsNotFound", IsNotFound(fp.Err()))
+}
+
+func TestContactsPager(t *testing.T) {
+	httpClient, n := newSequenceClient(t,
+		xmlResponse(`<rsp stat="ok"><contacts page="1" pages="2">
+          <contact nsid="a" username="A" /><contact nsid="b" username="B" /></contacts></rsp>`),
+		xmlResponse(`<rsp stat="ok"><contacts page="2" pages="2">
+          <contact nsid="b" username="B" /><contact nsid="c" username="C" /></contacts></rsp>`))
+	c := New(apiKey, secret, httpClient)
+	c.RateLimiter = nil
+	p := c.ContactsGetPublicListPager(context.Background(), ContactsGetPublicListParams{UserID: "me"})
+	var names []string
+	for p.Next() {
+		names = append(names, p.Item().UserName)
+	}
+	assertOK(t, "err", p.Err())
+	assertEq(t, "names", "A B C", strings.Join(names, " "))
+	assertEq(t, "requests", 2, *n)
+}
+
+func TestPagerPrefetch(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	var requested []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		page := r.URL.Query().Get("page")
+		n, _ := strconv.Atoi(page)
+		mu.Lock()
+		requested = append(requested, page)
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		// Later pages finish first.
+		time.Sleep(time.Duration(10-n) * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		if page == "7" {
+			return statusResponse(http.StatusInternalServerError)()
+		}
+		return xmlResponse(fmt.Sprintf(`<rsp stat="ok"><photos page="%d" pages="8">
+          <photo id="%da" /><photo id="%db" /></photos></rsp>`, n, n, n))()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = nil
+
+	p := c.PhotosSearchPager(context.Background(), PhotosSearchParams{})
+	p.Prefetch = 3
+	p.MaxItems = 12
+	assertEq(t, "ids", "1a 1b 2a 2b 3a 3b 4a 4b 5a 5b 6a 6b", collectPhotoIDs(p))
+	assertOK(t, "err", p.Err())
+	mu.Lock()
+	assert(t, "concurrent", maxInFlight > 1)
+	assert(t, "bounded", maxInFlight <= 3)
+	mu.Unlock()
+
+	mu.Lock()
+	requested = nil
+	mu.Unlock()
+	p = c.PhotosSearchPager(context.Background(), PhotosSearchParams{})
+	p.Prefetch = 4
+	assertEq(t, "ids before error", "1a 1b 2a 2b 3a 3b 4a 4b 5a 5b 6a 6b", collectPhotoIDs(p))
+	var httpErr *HTTPError
+	assert(t, "error", errors.As(p.Err(), &httpErr))
+	mu.Lock()
+	assertEq(t, "first page alone", "1", requested[0])
+	for _, page := range requested {
+		assert(t, "page "+page+" in range", page != "9")
+	}
+	mu.Unlock()
+
+	// The pages being fetched are abandoned when the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	p = c.PhotosSearchPager(ctx, PhotosSearchParams{})
+	p.Prefetch = 2
+	assert(t, "first", p.Next())
+	cancel()
+	for p.Next() {
+	}
+	assert(t, "cancelled", errors.Is(p.Err(), context.Canceled))
+}
+
+func TestPagerPrefetchWindow(t *testing.T) {
+	var mu sync.Mutex
+	var requested []int
+	getFn := func(r *http.Request) (*http.Response, error) {
+		q := r.URL.Query()
+		n, _ := strconv.Atoi(q.Get("page"))
+		mu.Lock()
+		requested = append(requested, n)
+		mu.Unlock()
+		if q.Get("method") == "flickr.photos.search" {
+			return xmlResponse(fmt.Sprintf(`<rsp stat="ok"><photos page="%d" pages="1000000000">
+              <photo id="%d" /></photos></rsp>`, n, n))()
+		}
+		return xmlResponse(fmt.Sprintf(`<rsp stat="ok"><contacts page="%d" pages="1000000000">
+          <contact nsid="%d" /></contacts></rsp>`, n, n))()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = nil
+
+	// Only the pages in the window are tracked, however many Flickr reports.
+	p := c.ContactsGetPublicListPager(context.Background(), ContactsGetPublicListParams{UserID: "me"})
+	p.Prefetch = 3
+	n := 0
+	for p.Next() && n < 20 {
+		n++
+		if p.ahead != nil {
+			p.ahead.mu.Lock()
+			assert(t, fmt.Sprintf("window at %d", n), len(p.ahead.results) <= 4)
+			p.ahead.mu.Unlock()
+		}
+	}
+	p.Close()
+	assertEq(t, "contacts", 20, n)
+
+	// Searches are not prefetched past the last page Flickr returns results
+	// on.
+	mu.Lock()
+	requested = nil
+	mu.Unlock()
+	sp := c.PhotosSearchPager(context.Background(), PhotosSearchParams{PerPage: 500})
+	sp.Prefetch = 4
+	ids := collectPhotoIDs(sp)
+	assertEq(t, "search", "1 2 3 4 5 6 7 8", ids)
+	mu.Lock()
+	sort.Ints(requested)
+	assertEq(t, "search pages", "[1 2 3 4 5 6 7 8]", fmt.Sprint(requested))
+	mu.Unlock()
+}
+
+// -----------------------
+// Tests for search.go
+//
+// Serves searches over photos uploaded, or taken if field is "taken", at the
+// given Unix times, returning no more than searchResultLimit of them per
+// search.  Upload dates are read as Unix timestamps, and taken dates only as
+// MySQL datetimes.  Searches are appended to searches as "min-max/page", with
+// Unix times.
+func newDatedSearchClient(t *testing.T, field string, uploaded []int64, searches *[]string) *Client {
+	date := func(v string) int64 {
+		if field == "upload" {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			return n
+		}
+		d, err := time.Parse(mysqlDatetime, v)
+		if err != nil {
+			t.Errorf("taken date %q: %v", v, err)
+		}
+		return d.Unix()
+	}
+	getFn := func(r *http.Request) (*http.Response, error) {
+		q := r.URL.Query()
+		min := date(q.Get("min_" + field + "_date"))
+		max := date(q.Get("max_" + field + "_date"))
+		perPage, _ := strconv.Atoi(q.Get("per_page"))
+		page, _ := strconv.Atoi(q.Get("page"))
+		*searches = append(*searches, fmt.Sprintf("%d-%d/%d", min, max, page))
+		var matching []int
+		for i, u := range uploaded {
+			if u >= min && u <= max {
+				matching = append(matching, i)
+			}
+		}
+		photos := ""
+		for i := (page - 1) * perPage; i < page*perPage && i < len(matching) && i < searchResultLimit; i++ {
+			photos += fmt.Sprintf(`<photo id="%d" />`, matching[i])
+		}
+		pages := (len(matching) + perPage - 1) / perPage
+		return xmlResponse(fmt.Sprintf(`<rsp stat="ok"><photos page="%d" pages="%d" perpage="%d" total="%d">%s</photos></rsp>`,
+			page, pages, perPage, len(matching), photos))()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = nil
+	return c
+}
+
+func TestCompleteSearch(t *testing.T) {
+	defer func(l int) { searchResultLimit = l }(searchResultLimit)
+	searchResultLimit = 10
+
+	var uploaded []int64
+	for i := int64(0); i < 50; i++ {
+		// Some photos share an upload time.
+		uploaded = append(uploaded, 1000+i/2*7)
+	}
+	var searches []string
+	c := newDatedSearchClient(t, "upload", uploaded, &searches)
+	p := c.CompleteSearch(context.Background(), PhotosSearchParams{
+		MinUploadDate: time.Unix(1000, 0),
+		MaxUploadDate: time.Unix(2000, 0),
+		PerPage:       4,
+	}, DateUploaded)
+	seen := make(map[string]int)
+	for p.Next() {
+		seen[p.Item().ID]++
+	}
+	assertOK(t, "err", p.Err())
+	assertEq(t, "found", len(uploaded), len(seen))
+	for id, n := range seen {
+		assertEq(t, "once "+id, 1, n)
+	}
+	assertEq(t, "first search", "1000-2000/1", searches[0])
+	assert(t, "split", len(searches) > 13)
+
+	// Searches under the limit are not split.
+	searches = nil
+	p = c.CompleteSearch(context.Background(), PhotosSearchParams{
+		MinUploadDate: time.Unix(1000, 0),
+		MaxUploadDate: time.Unix(1020, 0),
+		PerPage:       4,
+	}, DateUploaded)
+	n := 0
+	for p.Next() {
+		n++
+	}
+	assertEq(t, "small.found", 6, n)
+	assertEq(t, "small.searches", "1000-1020/1 1000-1020/2", strings.Join(searches, " "))
+}
+
+func TestCompleteSearchRepeatedPage(t *testing.T) {
+	defer func(l int) { searchResultLimit = l }(searchResultLimit)
+	searchResultLimit = 4
+
+	// Splits into 1000-1500, whose second page repeats the first, and
+	// 1501-2000.
+	results := map[string]string{
+		"1000-2000/1": `total="5" pages="3"><photo id="1" /><photo id="2" />`,
+		"1000-1500/1": `total="3" pages="3"><photo id="1" /><photo id="2" />`,
+		"1000-1500/2": `total="3" pages="3"><photo id="1" /><photo id="2" />`,
+		"1501-2000/1": `total="1" pages="1"><photo id="3" />`,
+	}
+	var searches []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		q := r.URL.Query()
+		s := q.Get("min_upload_date") + "-" + q.Get("max_upload_date") + "/" + q.Get("page")
+		searches = append(searches, s)
+		res, ok := results[s]
+		if !ok {
+			t.Errorf("unexpected search %s", s)
+		}
+		return xmlResponse(`<rsp stat="ok"><photos page="1" ` + res + `</photos></rsp>`)()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	c.RateLimiter = nil
+	p := c.CompleteSearch(context.Background(), PhotosSearchParams{
+		MinUploadDate: time.Unix(1000, 0),
+		MaxUploadDate: time.Unix(2000, 0),
+		PerPage:       2,
+	}, DateUploaded)
+	assertEq(t, "ids", "1 2 3", collectPhotoIDs(p))
+	assertOK(t, "err", p.Err())
+	assertEq(t, "searches", "1000-2000/1 1000-1500/1 1000-1500/2 1501-2000/1", strings.Join(searches, " "))
+}
+
+func TestCompleteSearchTakenDates(t *testing.T) {
+	var queries []url.Values
+	getFn := func(r *http.Request) (*http.Response, error) {
+		queries = append(queries, r.URL.Query())
+		return xmlResponse(`<rsp stat="ok"><photos page="1" pages="1" total="1"><photo id="1" /></photos></rsp>`)()
+	}
+	c := New(apiKey, secret, newHTTPClient(getFn))
+	before := time.Now().Unix()
+	p := c.CompleteSearch(context.Background(), PhotosSearchParams{Tags: "cat"}, DateTaken)
+	assert(t, "next", p.Next())
+	assert(t, "done", !p.Next())
+	assertOK(t, "err", p.Err())
+	assertEq(t, "searches", 1, len(queries))
+	q := queries[0]
+	assertEq(t, "tags", "cat", q.Get("tags"))
+	assertEq(t, "min", "1800-01-01 00:00:00", q.Get("min_taken_date"))
+	max, err := time.Parse(mysqlDatetime, q.Get("max_taken_date"))
+	assertOK(t, "max", err)
+	assert(t, "max", max.Unix() >= before)
+	assertEq(t, "upload dates", "", q.Get("min_upload_date")+q.Get("max_upload_date"))
+	assertEq(t, "per_page", "500", q.Get("per_page"))
+}
+
+func TestCompleteSearchBefore1970(t *testing.T) {
+	defer func(l int) { searchResultLimit = l }(searchResultLimit)
+	searchResultLimit = 2
+
+	// Taken in 1825, 1906, 1969 and 2001.
+	taken := []int64{-4575744000, -2000000000, -2000000000, -1000, 1000000000}
+	var searches []string
+	c := newDatedSearchClient(t, "taken", taken, &searches)
+	p := c.CompleteSearch(context.Background(), PhotosSearchParams{PerPage: 4}, DateTaken)
+	var ids []string
+	for p.Next() {
+		ids = append(ids, p.Item().ID)
+	}
+	assertOK(t, "err", p.Err())
+	assertEq(t, "ids", "0 1 2 3 4", strings.Join(ids, " "))
+	assert(t, "split", len(searches) > 3)
+
+	// Taken dates are sent in UTC, however they are given.
+	args := StructToMap(PhotosSearchParams{
+		MinTakenDate:  time.Date(1500, 1, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600)),
+		MinUploadDate: time.Unix(1000, 0),
+	})
+	assertEq(t, "1500", "1500-01-01 00:00:00", args["min_taken_date"])
+	assertEq(t, "upload date", "1000", args["min_upload_date"])
+}
+
+func TestSearchBuilder(t *testing.T) {
+	min := time.Unix(1300000000, 0)
+	params, err := NewSearch().
+		User("me").
+		Tags(TagModeAll, "sunset", "-beach").
+		MachineTags(TagModeAny, "dc:title=", "geo:lat=").
+		UploadedBetween(min, time.Time{}).
+		Near(51.5, -0.125, 5.5, RadiusKilometers).
+		Licenses(4, 5).
+		Sort(SortInterestingnessDesc).
+		ContentTypes(ContentPhoto, ContentOther).
+		Media(MediaPhotos).
+		HasGeo(true).
+		GeoContext(GeoContextOutdoors).
+		Privacy(PrivacyFriends).
+		Extras("url_m", "date_taken").
+		PerPage(500).
+		Page(2).
+		Build()
+	assertOK(t, "Build", err)
+	args := StructToMap(params)
+	expected := map[string]string{
+		"user_id":          "me",
+		"tags":             "sunset,-beach",
+		"tag_mode":         "all",
+		"machine_tags":     "dc:title=,geo:lat=",
+		"machine_tag_mode": "any",
+		"min_upload_date":  "1300000000",
+		"lat":              "51.5",
+		"lon":              "-0.125",
+		"radius":           "5.5",
+		"radius_units":     "km",
+		"license":          "4,5",
+		"sort":             "interestingness-desc",
+		"content_type":     "6",
+		"media":            "photos",
+		"has_geo":          "1",
+		"geo_context":      "2",
+		"privacy_filter":   "2",
+		"extras":           "url_m,date_taken",
+		"per_page":         "500",
+		"page":             "2",
+	}
+	assertEq(t, "len", len(expected), len(args))
+	for k, v := range expected {
+		assertEq(t, k, v, args[k])
+	}
+
+	params, err = NewSearch().Text("castle").BBox(-1.5, 50, 1.5, 52).Build()
+	assertOK(t, "bbox", err)
+	assertEq(t, "bbox", "-1.5,50,1.5,52", params.BBox)
+}
+
+func TestSearchBuilderErrors(t *testing.T) {
+	manyTags := func(n int) []string {
+		var tags []string
+		for i := 0; i < n; i++ {
+			tags = append(tags, fmt.Sprintf("ns:p=%d", i))
+		}
+		return tags
+	}
+	tests := []struct {
+		id      string
+		b       *SearchBuilder
+		message string
+	}{
+		{"per page", NewSearch().PerPage(501), "per_page 501"},
+		{"zero per page", NewSearch().PerPage(0), "per_page 0"},
+		{"page", NewSearch().Page(0), "invalid page 0"},
+		{"radius", NewSearch().Text("a").Near(1, 2, 33, RadiusKilometers), "radius \"33\""},
+		{"radius miles", NewSearch().Text("a").Near(1, 2, 21, RadiusMiles), "at most 20"},
+		{"lat", NewSearch().Text("a").Near(91, 2, 1, RadiusKilometers), "lat 91"},
+		{"bbox order", NewSearch().Text("a").BBox(10, 50, 5, 52), "is not ordered"},
+		{"bbox range", NewSearch().Text("a").BBox(-200, 50, 5, 52), "longitude -200"},
+		{"machine tags all", NewSearch().MachineTags(TagModeAll, manyTags(17)...), "at most 16"},
+		{"machine tags any", NewSearch().MachineTags(TagModeAny, manyTags(9)...), "at most 8"},
+		{"limiting agent", NewSearch().BBox(-1, -1, 1, 1), "limiting agent"},
+		{"limiting agent place", NewSearch().Place("abc").Sort(SortRelevance), "last 12 hours"},
+		{"sort", NewSearch().Sort("newest"), "invalid sort order"},
+		{"media", NewSearch().Media("pictures"), "invalid media"},
+		{"tag", NewSearch().Tags(TagModeAny, "a,b"), "invalid tag"},
+		{"content type", NewSearch().ContentTypes(9), "invalid content type 9"},
+		{"dates", NewSearch().TakenBetween(time.Unix(2000, 0), time.Unix(1000, 0)), "max_taken_date"},
+	}
+	for _, test := range tests {
+		_, err := test.b.Build()
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("[%s] expected error containing %q, found %v", test.id, test.message, err)
+		}
+	}
+
+	// Every problem is reported.
+	_, err := NewSearch().PerPage(600).Sort("newest").BBox(1, 1, 0, 0).Build()
+	assertEq(t, "all problems", 4, strings.Count(err.Error(), "\n")+1)
+
+	machineTags := strings.Join(manyTags(9), ",")
+	p := PhotosSearchParams{MachineTags: machineTags, MachineTagMode: "all"}
+	assertOK(t, "Validate", p.Validate())
+	p = PhotosSearchParams{Lat: "1", Radius: "2"}
+	assert(t, "lat without lon", p.Validate() != nil)
+}
+
+func TestPhotoExtras(t *testing.T) {
+	assertEq(t, "extras", "date_taken,url_m,url_o",
+		Extras{ExtraDateTaken, ExtraURLM, ExtraDateTaken, "", ExtraURLO}.String())
+	assertEq(t, "no extras", "", Extras(nil).String())
+	assertEq(t, "url extras", 10, len(strings.Split(ExtrasURLs.String(), ",")))
+
+	xmlStr := `<rsp stat="ok">
+      <photos page="1" pages="1" perpage="100" total="1">
+        <photo id="2636" owner="47058503995@N01" secret="a123456" server="2" farm="1"
+            title="test_04" ispublic="1" license="4" dateupload="1151613424"
+            lastupdate="1295974620" datetaken="2006-06-29 13:37:04"
+            datetakengranularity="0" datetakenunknown="0" ownername="Bees"
+            iconserver="1" iconfarm="1" originalsecret="b123" originalformat="jpg"
+            latitude="51.500152" longitude="-0.126236" accuracy="16" context="2"
+            place_id="hP_s5s9VVr5Qcg" woeid="44417" tags="london parliament big"
+            machine_tags="geo:lat=51.5" o_width="3072" o_height="2304" views="123"
+            media="photo" pathalias="bees"
+            url_sq="https://live.staticflickr.com/2/2636_a123456_s.jpg" height_sq="75" width_sq="75"
+            url_o="https://live.staticflickr.com/2/2636_b123_o.jpg" height_o="2304" width_o="3072">
+          <description>Big Ben</description>
+        </photo>
+      </photos>
+    </rsp>`
+	jsonStr := `{"photos":{"page":1,"pages":1,"perpage":100,"total":"1","photo":[
+        {"id":"2636","owner":"47058503995@N01","secret":"a123456","server":"2","farm":1,
+         "title":"test_04","ispublic":1,"license":"4","dateupload":"1151613424",
+         "lastupdate":"1295974620","datetaken":"2006-06-29 13:37:04",
+         "datetakengranularity":"0","datetakenunknown":"0","ownername":"Bees",
+         "iconserver":"1","iconfarm":1,"originalsecret":"b123","originalformat":"jpg",
+         "latitude":51.500152,"longitude":-0.126236,"accuracy":"16","context":2,
+         "place_id":"hP_s5s9VVr5Qcg","woeid":"44417","tags":"london parliament big",
+         "machine_tags":"geo:lat=51.5","o_width":"3072","o_height":"2304","views":"123",
+         "media":"photo","pathalias":"bees",
+         "url_sq":"https://live.staticflickr.com/2/2636_a123456_s.jpg","height_sq":75,"width_sq":75,
+         "url_o":"https://live.staticflickr.com/2/2636_b123_o.jpg","height_o":"2304","width_o":"3072",
+         "description":{"_content":"Big Ben"}}]},
+      "stat":"ok"}`
+	search := func(c *Client) (interface{}, error) {
+		c.RateLimiter = nil
+		return c.PhotosSearch(PhotosSearchParams{Extras: "date_taken"})
+	}
+	assertSameDecoding(t, "extras", xmlStr, jsonStr, search)
+
+	httpClient, _ := newSequenceClient(t, xmlResponse(xmlStr))
+	r, err := search(New(apiKey, secret, httpClient))
+	assertOK(t, "search", err)
+	p := r.(*SearchResponse).Photos[0]
+	assertEq(t, "description", "Big Ben", p.Description)
+	assertEq(t, "license", "4", p.License)
+	assertEq(t, "dateupload", int64(1151613424), p.DateUpload.Unix())
+	assertEq(t, "lastupdate", int64(1295974620), p.LastUpdate.Unix())
+	assertEq(t, "datetaken", time.Date(2006, 6, 29, 13, 37, 4, 0, time.UTC), p.DateTaken.Time)
+	assertEq(t, "ownername", "Bees", p.OwnerName)
+	assertEq(t, "originalformat", "jpg", p.OriginalFormat)
+	assertEq(t, "latitude", 51.500152, p.Latitude)
+	assertEq(t, "longitude", -0.126236, p.Longitude)
+	assertEq(t, "accuracy", 16, p.Accuracy)
+	assertEq(t, "woeid", "44417", p.WoeID)
+	assertEq(t, "tags", "london|parliament|big", strings.Join(p.Tags, "|"))
+	assertEq(t, "machine_tags", "geo:lat=51.5", strings.Join(p.MachineTags, "|"))
+	assertEq(t, "o_dims", "3072x2304", fmt.Sprintf("%dx%d", p.OriginalWidth, p.OriginalHeight))
+	assertEq(t, "views", 123, p.Views)
+	assertEq(t, "media", "photo", p.Media)
+	assertEq(t, "pathalias", "bees", p.PathAlias)
+	assertEq(t, "sizes", 2, len(p.Sizes))
+	assertEq(t, "sq", PhotoSize{"https://live.staticflickr.com/2/2636_a123456_s.jpg", 75, 75}, p.Sizes["sq"])
+	assertEq(t, "o", PhotoSize{"https://live.staticflickr.com/2/2636_b123_o.jpg", 3072, 2304}, p.Sizes["o"])
+
+	var taken FlickrTime
+	assertOK(t, "unknown date", taken.UnmarshalText([]byte("0000-00-00 00:00:00")))
+	assert(t, "unknown date.IsZero", taken.IsZero())
+	assert(t, "bad date", taken.UnmarshalText([]byte("29/06/2006")) != nil)
+}
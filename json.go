@@ -0,0 +1,247 @@
+package flickgo
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Response formats supported by Client.Format.
+const (
+	FormatXML  = ""
+	FormatJSON = "json"
+)
+
+// Decodes a Flickr JSON response into resp.  Response structs only carry xml
+// tags, so the JSON is mapped using those: attributes and child elements
+// become object keys, text content is read from Flickr's "_content" key, and
+// repeated elements may be either arrays or single objects.  This gives the
+// same Go values as decoding the equivalent XML response.  The JSONP wrapper
+// is stripped if present.
+func decodeJSON(data []byte, resp interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(extractJSON(data)))
+	d.UseNumber()
+	var root interface{}
+	if err := d.Decode(&root); err != nil {
+		return err
+	}
+	obj, ok := root.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected JSON value %T", root)
+	}
+	v := reflect.ValueOf(resp).Elem()
+	if err := jsonFill(v, obj); err != nil {
+		return err
+	}
+	// Unlike XML, failures are reported at the top level rather than in an
+	// err element.
+	if r, ok := resp.(apiResponse); ok && r.status().Stat != "ok" {
+		st := r.status()
+		if err := jsonSet(reflect.ValueOf(&st.Err.Code).Elem(), obj["code"]); err != nil {
+			return err
+		}
+		st.Err.Msg, _ = jsonString(obj["message"])
+	}
+	return nil
+}
+
+// Populates struct v from obj, following v's xml tags.
+func jsonFill(v reflect.Value, obj map[string]interface{}) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("xml")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		name, flags := tag, ""
+		if j := strings.Index(tag, ","); j >= 0 {
+			name, flags = tag[:j], tag[j+1:]
+		}
+		fv := v.Field(i)
+		if f.Anonymous && name == "" {
+			if fv.Kind() == reflect.Struct {
+				if err := jsonFill(fv, obj); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		var node interface{}
+		switch {
+		case flags == "chardata":
+			node = obj["_content"]
+		case flags == "innerxml" || flags == "comment" || flags == "any":
+			continue
+		default:
+			if name == "" {
+				name = f.Name
+			}
+			node = jsonPath(obj, strings.Split(name, ">"))
+		}
+		if node == nil {
+			continue
+		}
+		if err := jsonSet(fv, node); err != nil {
+			return fmt.Errorf("field %s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// Follows path through nested objects and returns the value at its end, or
+// nil if there is none.
+func jsonPath(obj map[string]interface{}, path []string) interface{} {
+	node := interface{}(obj)
+	for _, p := range path {
+		o, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = o[p]
+	}
+	return node
+}
+
+// Returns node as a string.  Objects are treated as text elements.
+func jsonString(node interface{}) (string, bool) {
+	switch n := node.(type) {
+	case string:
+		return n, true
+	case json.Number:
+		return n.String(), true
+	case bool:
+		if n {
+			return "1", true
+		}
+		return "0", true
+	case map[string]interface{}:
+		return jsonString(n["_content"])
+	}
+	return "", false
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Implemented by types that decode attributes their xml tags cannot name,
+// such as the url_* extras of photos.
+type attrUnmarshaler interface {
+	unmarshalAttrs(attrs map[string]string)
+}
+
+// Stores node in v, converting between JSON and Go types the way
+// encoding/xml converts attribute and text values.
+func jsonSet(v reflect.Value, node interface{}) error {
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		s, _ := jsonString(node)
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return jsonSet(v.Elem(), node)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s, _ := jsonString(node)
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		items, ok := node.([]interface{})
+		if !ok {
+			items = []interface{}{node}
+		}
+		for _, item := range items {
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := jsonSet(e, item); err != nil {
+				return err
+			}
+			v.Set(reflect.Append(v, e))
+		}
+		return nil
+	case reflect.Struct:
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			// A bare value stands for the text content of an element.
+			obj = map[string]interface{}{"_content": node}
+		}
+		if err := jsonFill(v, obj); err != nil {
+			return err
+		}
+		if !v.CanAddr() {
+			return nil
+		}
+		if u, ok := v.Addr().Interface().(attrUnmarshaler); ok {
+			attrs := make(map[string]string)
+			for k, n := range obj {
+				if s, ok := n.(string); ok {
+					attrs[k] = s
+				} else if n, ok := n.(json.Number); ok {
+					attrs[k] = n.String()
+				}
+			}
+			u.unmarshalAttrs(attrs)
+		}
+		return nil
+	}
+
+	s, ok := jsonString(node)
+	if !ok {
+		return fmt.Errorf("cannot store %T in %v", node, v.Type())
+	}
+	if v.Kind() == reflect.String {
+		v.SetString(s)
+		return nil
+	}
+	s = strings.TrimSpace(s)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if s == "" {
+			v.SetInt(0)
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if s == "" {
+			v.SetUint(0)
+			return nil
+		}
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if s == "" {
+			v.SetFloat(0)
+			return nil
+		}
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		if s == "" {
+			v.SetBool(false)
+			return nil
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package flickgo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Number of bytes at the start of a file read to detect its content type.
+const sniffLen = 512
+
+// Content types of the file formats Flickr accepts, by file extension.
+var extContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".jpe":  "image/jpeg",
+	".gif":  "image/gif",
+	".png":  "image/png",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".webp": "image/webp",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".mpg":  "video/mpeg",
+	".mpeg": "video/mpeg",
+	".m2ts": "video/mp2t",
+	".mts":  "video/mp2t",
+	".wmv":  "video/x-ms-wmv",
+	".3gp":  "video/3gpp",
+	".ogv":  "video/ogg",
+	".ogg":  "video/ogg",
+}
+
+// Leading bytes identifying file formats.
+var magicNumbers = []struct {
+	offset      int
+	magic       string
+	contentType string
+}{
+	{0, "\xff\xd8\xff", "image/jpeg"},
+	{0, "\x89PNG\r\n\x1a\n", "image/png"},
+	{0, "GIF87a", "image/gif"},
+	{0, "GIF89a", "image/gif"},
+	{0, "II*\x00", "image/tiff"},
+	{0, "MM\x00*", "image/tiff"},
+	{0, "\x00\x00\x01\xba", "video/mpeg"},
+	{0, "\x00\x00\x01\xb3", "video/mpeg"},
+	{0, "\x30\x26\xb2\x75\x8e\x66\xcf\x11", "video/x-ms-wmv"},
+	{0, "OggS", "video/ogg"},
+	// QuickTime files without an ftyp box.
+	{4, "moov", "video/quicktime"},
+	{4, "mdat", "video/quicktime"},
+	{4, "wide", "video/quicktime"},
+}
+
+// Content types of ISO base media files (MP4, QuickTime, HEIF, 3GP), by the
+// major brand in their ftyp box.
+var ftypBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"qt  ": "video/quicktime",
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"iso4": "video/mp4",
+	"iso5": "video/mp4",
+	"iso6": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"M4V ": "video/mp4",
+	"dash": "video/mp4",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+	"3g2a": "video/3gpp2",
+}
+
+// Returns the content type of a file in a format Flickr accepts, given the
+// first bytes of the file, or "" if head is not recognised.
+func sniffContentType(head []byte) string {
+	for _, m := range magicNumbers {
+		if bytes.HasPrefix(head[min(m.offset, len(head)):], []byte(m.magic)) {
+			return m.contentType
+		}
+	}
+	if len(head) >= 12 && string(head[0:4]) == "RIFF" {
+		switch string(head[8:12]) {
+		case "WEBP":
+			return "image/webp"
+		case "AVI ":
+			return "video/x-msvideo"
+		}
+	}
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		return ftypBrands[string(head[8:12])]
+	}
+	// MPEG transport streams consist of 188 byte packets starting with
+	// 0x47; M2TS adds a 4 byte timestamp to each.
+	for _, n := range []int{188, 192} {
+		start := n - 188
+		if len(head) > start+n && head[start] == 0x47 && head[start+n] == 0x47 {
+			return "video/mp2t"
+		}
+	}
+	return ""
+}
+
+// Returns the content type of a file Flickr accepts, detected from head, the
+// first bytes of the file.  The extension of name is only used if head is
+// not recognised at all; files recognised as being in another format, such
+// as a PDF or a text file named photo.jpg, and files in formats Flickr does
+// not accept are rejected with an error wrapping ErrFiletypeUnsupported.
+func DetectContentType(name string, head []byte) (string, error) {
+	if t := sniffContentType(head); t != "" {
+		return t, nil
+	}
+	// http.DetectContentType reports nothing at all as text.
+	if t := http.DetectContentType(head); len(head) > 0 && t != "application/octet-stream" {
+		return "", fmt.Errorf("%s: detected %s: %w", name, t, ErrFiletypeUnsupported)
+	}
+	if t, ok := extContentTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return t, nil
+	}
+	return "", fmt.Errorf("%s: %w", name, ErrFiletypeUnsupported)
+}
+
+// Detects the content type of file from its first bytes.  The returned
+// UploadFile reads the whole file again: seekable readers are rewound, others
+// are prefixed with the bytes read.
+func sniffFile(file UploadFile) (UploadFile, string, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file.Reader, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return file, "", wrapErr("reading file failed", err)
+	}
+	head = head[:n]
+	if s, ok := file.Reader.(io.Seeker); ok {
+		if _, err := s.Seek(-int64(n), io.SeekCurrent); err != nil {
+			return file, "", wrapErr("rewinding file failed", err)
+		}
+	} else {
+		file.Reader = io.MultiReader(bytes.NewReader(head), file.Reader)
+	}
+	t, err := DetectContentType(file.Name, head)
+	return file, t, err
+}
@@ -0,0 +1,321 @@
+package flickgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Temporary credentials issued at the start of the OAuth flow.  See
+// https://www.flickr.com/services/api/auth.oauth.html.
+type RequestToken struct {
+	Token  string
+	Secret string
+
+	// Whether Flickr accepted the callback URL passed to GetRequestToken.
+	CallbackConfirmed bool
+}
+
+// Credentials for acting on behalf of a user, obtained by exchanging an
+// authorised RequestToken.  Access tokens do not expire.
+type AccessToken struct {
+	Token  string
+	Secret string
+	User   User
+
+	// Permission level granted by the user.  Only set for tokens returned by
+	// ExchangeAuthToken; use CheckToken to find it for others.
+	Perms string
+}
+
+// Returns the credentials for acting with this token.
+func (t *AccessToken) Credentials() Credentials {
+	return Credentials{Token: t.Token, Secret: t.Secret, NSID: t.User.NSID, Perms: t.Perms}
+}
+
+// Sources of the nonce and timestamp sent with every signed request.  Tests
+// replace these to get reproducible signatures.
+var (
+	oauthNonce = func() string {
+		b := make([]byte, 16)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}
+	oauthTime = time.Now
+)
+
+// Percent-encodes s as described in RFC 5849, section 3.6.  This differs from
+// url.QueryEscape in how spaces and '~' are treated.
+func oauthEscape(s string) string {
+	buf := bytes.NewBuffer(make([]byte, 0, len(s)))
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '.', b == '_', b == '~':
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+// Returns the signature base string for a request.  baseURL must not contain
+// a query string; all query and form arguments are passed in args.
+func oauthBaseString(method string, baseURL string, args map[string]string) string {
+	// Sorted by encoded name, then by encoded value, as required by RFC 5849,
+	// section 3.4.1.3.2.  Sorting the joined "name=value" strings instead
+	// would put "a-b" before "a", since '-' sorts before '='.
+	pairs := make([][2]string, 0, len(args))
+	for k, v := range args {
+		pairs = append(pairs, [2]string{oauthEscape(k), oauthEscape(v)})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	params := make([]string, len(pairs))
+	for i, p := range pairs {
+		params[i] = p[0] + "=" + p[1]
+	}
+	return strings.ToUpper(method) + "&" + oauthEscape(baseURL) + "&" +
+		oauthEscape(strings.Join(params, "&"))
+}
+
+// Returns the HMAC-SHA1 signature for a request.  tokenSecret is empty when
+// signing the request for a request token.
+func oauthSign(consumerSecret string, tokenSecret string, method string,
+	baseURL string, args map[string]string) string {
+	key := oauthEscape(consumerSecret) + "&" + oauthEscape(tokenSecret)
+	h := hmac.New(sha1.New, []byte(key))
+	h.Write([]byte(oauthBaseString(method, baseURL, args)))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Returns a copy of args with the OAuth protocol arguments and the signature
+// added.  token and tokenSecret may be empty for calls not made on behalf of a
+// user.
+func oauthArgs(c *Client, method string, baseURL string, args map[string]string,
+	token string, tokenSecret string) map[string]string {
+	a := clone(args)
+	a["oauth_consumer_key"] = c.apiKey
+	a["oauth_nonce"] = oauthNonce()
+	a["oauth_timestamp"] = strconv.FormatInt(oauthTime().Unix(), 10)
+	a["oauth_signature_method"] = "HMAC-SHA1"
+	a["oauth_version"] = "1.0"
+	if token != "" {
+		a["oauth_token"] = token
+	}
+	a["oauth_signature"] = oauthSign(c.secret, tokenSecret, method, baseURL, a)
+	return a
+}
+
+// Sends a signed GET request to one of the OAuth endpoints and returns the
+// form-encoded response.
+func oauthGet(ctx context.Context, c *Client, endpoint string, args map[string]string,
+	token string, tokenSecret string) (url.Values, error) {
+	u := c.oauthEndpoint(endpoint)
+	a := oauthArgs(c, "GET", u, args, token, tokenSecret)
+	u += "?" + queryValues(a).Encode()
+	if c.Logger != nil {
+		c.Logger.Debugf("GET %v\n", u)
+	}
+	in, err := fetch(ctx, c, u)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	body, rErr := ioutil.ReadAll(in)
+	if rErr != nil {
+		return nil, wrapErr("reading response failed", rErr)
+	}
+	v, pErr := url.ParseQuery(string(body))
+	if pErr != nil {
+		return nil, wrapErr("parsing response failed", pErr)
+	}
+	if p := v.Get("oauth_problem"); p != "" {
+		return nil, fmt.Errorf("Flickr OAuth error: %s", p)
+	}
+	if v.Get("oauth_token") == "" || v.Get("oauth_token_secret") == "" {
+		return nil, errors.New("Flickr OAuth error: token missing in response")
+	}
+	return v, nil
+}
+
+// Obtains a request token, the first step of the OAuth flow.  callback is the
+// URL the user is sent to after authorising the app; pass "oob" if the app
+// cannot receive callbacks, in which case Flickr shows the verifier to the
+// user instead.
+func (c *Client) GetRequestToken(callback string) (*RequestToken, error) {
+	return c.GetRequestTokenContext(context.Background(), callback)
+}
+
+// Same as GetRequestToken, but ctx controls cancellation of the call.
+func (c *Client) GetRequestTokenContext(ctx context.Context, callback string) (*RequestToken, error) {
+	v, err := oauthGet(ctx, c, "request_token",
+		map[string]string{"oauth_callback": callback}, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return &RequestToken{
+		Token:             v.Get("oauth_token"),
+		Secret:            v.Get("oauth_token_secret"),
+		CallbackConfirmed: v.Get("oauth_callback_confirmed") == "true",
+	}, nil
+}
+
+// Returns the URL for requesting authorisation to access the user's Flickr
+// account.  requestToken is the token returned by GetRequestToken.  perms
+// should be one of the following constants:
+//
+//	ReadPerm
+//	WritePerm
+//	DeletePerm
+func (c *Client) AuthURL(requestToken string, perms string) string {
+	args := map[string]string{"oauth_token": requestToken}
+	if perms != "" {
+		args["perms"] = perms
+	}
+	return c.oauthEndpoint("authorize") + "?" + queryValues(args).Encode()
+}
+
+// Exchanges an authorised request token and the verifier passed to the
+// callback URL for an access token.  Pass the token's Credentials to
+// Client.WithUser to make calls on behalf of the user.
+func (c *Client) GetAccessToken(rt *RequestToken, verifier string) (*AccessToken, error) {
+	return c.GetAccessTokenContext(context.Background(), rt, verifier)
+}
+
+// Same as GetAccessToken, but ctx controls cancellation of the call.
+func (c *Client) GetAccessTokenContext(ctx context.Context, rt *RequestToken, verifier string) (*AccessToken, error) {
+	v, err := oauthGet(ctx, c, "access_token",
+		map[string]string{"oauth_verifier": verifier}, rt.Token, rt.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return &AccessToken{
+		Token:  v.Get("oauth_token"),
+		Secret: v.Get("oauth_token_secret"),
+		User: User{
+			UserName: v.Get("username"),
+			NSID:     v.Get("user_nsid"),
+			FullName: v.Get("fullname"),
+		},
+	}, nil
+}
+
+// Exchanges an auth token issued by the legacy authentication API for an OAuth
+// access token.  Flickr invalidates authToken once the exchange succeeds, so
+// the returned token must be stored before discarding the old one.  The
+// token's User and Perms are looked up with CheckToken; if that fails, the
+// token is returned along with the error so that it is not lost.  See
+// https://www.flickr.com/services/api/flickr.auth.oauth.getAccessToken.html.
+func (c *Client) ExchangeAuthToken(authToken string) (*AccessToken, error) {
+	return c.ExchangeAuthTokenContext(context.Background(), authToken)
+}
+
+// Same as ExchangeAuthToken, but ctx controls cancellation of the call.
+func (c *Client) ExchangeAuthTokenContext(ctx context.Context, authToken string) (*AccessToken, error) {
+	r := struct {
+		apiStatus
+		Token struct {
+			Token  string `xml:"oauth_token,attr"`
+			Secret string `xml:"oauth_token_secret,attr"`
+		} `xml:"auth>access_token"`
+	}{}
+	method := "flickr.auth.oauth.getAccessToken"
+	if err := flickrGet(ctx, c, method, func() string {
+		return legacyURL(c, method, map[string]string{}, authToken)
+	}, &r); err != nil {
+		return nil, err
+	}
+	at := &AccessToken{Token: r.Token.Token, Secret: r.Token.Secret}
+	info, err := c.CheckTokenContext(ctx, at.Token, at.Secret)
+	if err != nil {
+		return at, wrapErr("checking new token failed", err)
+	}
+	at.User, at.Perms = info.User, info.Perms
+	return at, nil
+}
+
+// Credentials attached to an OAuth access token.
+type TokenInfo struct {
+	Token string `xml:"token"`
+	Perms string `xml:"perms"`
+	User  User   `xml:"user"`
+}
+
+// Validates an OAuth access token and returns the permissions it grants and
+// the user it belongs to.  See
+// https://www.flickr.com/services/api/flickr.auth.oauth.checkToken.html.
+func (c *Client) CheckToken(token string, tokenSecret string) (*TokenInfo, error) {
+	return c.CheckTokenContext(context.Background(), token, tokenSecret)
+}
+
+// Same as CheckToken, but ctx controls cancellation of the call.
+func (c *Client) CheckTokenContext(ctx context.Context, token string, tokenSecret string) (*TokenInfo, error) {
+	r := struct {
+		apiStatus
+		Info TokenInfo `xml:"oauth"`
+	}{}
+	method := "flickr.auth.oauth.checkToken"
+	if err := flickrGet(ctx, c, method, func() string {
+		return oauthURL(c, method, map[string]string{}, token, tokenSecret)
+	}, &r); err != nil {
+		return nil, err
+	}
+	return &r.Info, nil
+}
+
+// Outcome of migrating a single legacy auth token.
+type TokenMigration struct {
+	AuthToken string
+
+	// The OAuth access token; nil if the exchange failed.  It is set along
+	// with Err if only looking up its user failed, and must still be stored
+	// since the auth token is no longer valid.
+	AccessToken *AccessToken
+
+	// Reason the migration failed, or nil on success.
+	Err error
+}
+
+// Exchanges each of authTokens for an OAuth access token, one at a time.  A
+// failure to migrate one token does not stop the others; the returned slice
+// has one entry per token, in the order given.
+func (c *Client) MigrateAuthTokens(authTokens []string) []TokenMigration {
+	return c.MigrateAuthTokensContext(context.Background(), authTokens)
+}
+
+// Same as MigrateAuthTokens, but ctx controls cancellation of the calls.
+// Tokens not attempted before ctx is done are reported with ctx.Err().
+func (c *Client) MigrateAuthTokensContext(ctx context.Context, authTokens []string) []TokenMigration {
+	r := make([]TokenMigration, len(authTokens))
+	for i, t := range authTokens {
+		r[i].AuthToken = t
+		if err := ctx.Err(); err != nil {
+			r[i].Err = err
+			continue
+		}
+		r[i].AccessToken, r[i].Err = c.ExchangeAuthTokenContext(ctx, t)
+		if c.Logger != nil && r[i].Err != nil {
+			c.Logger.Debugf("migrating auth token %d failed: %v\n", i, r[i].Err)
+		}
+	}
+	return r
+}
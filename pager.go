@@ -0,0 +1,300 @@
+package flickgo
+
+import (
+	"context"
+	"sync"
+)
+
+// Iterates over the items of a paged Flickr response, fetching pages as
+// needed.  Items already returned on an earlier page are skipped, since
+// Flickr repeats items between pages when results change during paging.  A
+// page coming back empty, or holding only items returned already, ends the
+// iteration even if Flickr reported more pages.  Use it like bufio.Scanner:
+//
+//	p := c.PhotosSearchPager(ctx, params)
+//	for p.Next() {
+//		photo := p.Item()
+//		...
+//	}
+//	if err := p.Err(); err != nil {
+//		...
+//	}
+type Pager[T any] struct {
+	// Maximum number of items to return.  Zero means no limit.  Set it before
+	// the first call to Next.
+	MaxItems int
+
+	// Number of pages fetched concurrently once the first page has revealed
+	// the page count.  Fetching runs at most this many pages ahead of the
+	// items returned, and requests still go through the client's RateLimiter.
+	// Values below 2 fetch one page at a time.  Set it before the first call
+	// to Next, and call Close when abandoning the Pager early.
+	Prefetch int
+
+	ctx   context.Context
+	fetch func(ctx context.Context, page int) (items []T, pages int, err error)
+	id    func(T) string
+
+	page  int
+	pages int
+	items []T
+	item  T
+	seen  map[string]bool
+	n     int
+	done  bool
+	err   error
+
+	// Whether an item of the current page has been returned.
+	fresh bool
+
+	ahead *prefetcher[T]
+
+	// Set if fetch must be called for one page after the other.  Such a
+	// fetch skips pages holding only items returned already itself, since
+	// it knows which of its pages may still hold new ones.
+	sequential bool
+}
+
+// Result of fetching a page.
+type pageResult[T any] struct {
+	items []T
+	err   error
+}
+
+// Fetches pages on a fixed number of goroutines, no more than a window of
+// pages ahead of the ones taken.
+type prefetcher[T any] struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+
+	// Channels receiving the results of the pages in the window, by page.
+	mu      sync.Mutex
+	results map[int]chan pageResult[T]
+
+	// Closed when a page fails, to stop handing out further pages.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Starts fetching pages first through last with n goroutines.
+func startPrefetch[T any](ctx context.Context, n int, first int, last int,
+	fetch func(ctx context.Context, page int) ([]T, int, error)) *prefetcher[T] {
+	ctx, cancel := context.WithCancel(ctx)
+	f := &prefetcher[T]{
+		ctx:     ctx,
+		cancel:  cancel,
+		slots:   make(chan struct{}, n),
+		results: make(map[int]chan pageResult[T]),
+		stop:    make(chan struct{}),
+	}
+	pages := make(chan int)
+	go func() {
+		defer close(pages)
+		for i := first; i <= last; i++ {
+			select {
+			case f.slots <- struct{}{}:
+			case <-f.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case pages <- i:
+			case <-f.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		go func() {
+			for page := range pages {
+				items, _, err := fetch(ctx, page)
+				if err != nil {
+					// Paging ends at this page, so the ones after it are not
+					// needed.
+					f.stopOnce.Do(func() { close(f.stop) })
+				}
+				f.result(page) <- pageResult[T]{items, err}
+			}
+		}()
+	}
+	return f
+}
+
+// Returns the channel receiving the result of the given page.
+func (f *prefetcher[T]) result(page int) chan pageResult[T] {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch, ok := f.results[page]
+	if !ok {
+		ch = make(chan pageResult[T], 1)
+		f.results[page] = ch
+	}
+	return ch
+}
+
+// Waits for the given page and frees its slot in the window.
+func (f *prefetcher[T]) take(page int) ([]T, error) {
+	ch := f.result(page)
+	defer func() {
+		f.mu.Lock()
+		delete(f.results, page)
+		f.mu.Unlock()
+	}()
+	var r pageResult[T]
+	select {
+	case r = <-ch:
+		<-f.slots
+	case <-f.ctx.Done():
+		// The page may never have been handed to a goroutine.
+		select {
+		case r = <-ch:
+		default:
+			r.err = f.ctx.Err()
+		}
+	}
+	return r.items, r.err
+}
+
+// Returns a Pager that gets pages from fetch, starting at page 1.  id returns
+// the identity of items for skipping duplicates.
+func newPager[T any](ctx context.Context, id func(T) string,
+	fetch func(ctx context.Context, page int) ([]T, int, error)) *Pager[T] {
+	return &Pager[T]{ctx: ctx, fetch: fetch, id: id, seen: make(map[string]bool)}
+}
+
+// Advances to the next item, which is then available through Item.  Returns
+// false when there are no more items, MaxItems have been returned, or an
+// error occurred.
+func (p *Pager[T]) Next() bool {
+	for !p.done && p.err == nil {
+		if p.MaxItems > 0 && p.n >= p.MaxItems {
+			p.done = true
+			break
+		}
+		if len(p.items) > 0 {
+			it := p.items[0]
+			p.items = p.items[1:]
+			if id := p.id(it); id != "" {
+				if p.seen[id] {
+					continue
+				}
+				p.seen[id] = true
+			}
+			p.item = it
+			p.n++
+			p.fresh = true
+			return true
+		}
+		if p.page > 0 && (p.page >= p.pages || !p.fresh && !p.sequential) {
+			p.done = true
+			break
+		}
+		if err := p.ctx.Err(); err != nil {
+			p.err = err
+			break
+		}
+		items, err := p.fetchPage(p.page + 1)
+		if err != nil {
+			p.err = err
+			break
+		}
+		p.page++
+		p.items = items
+		p.fresh = false
+		if len(items) == 0 {
+			p.done = true
+		}
+	}
+	p.Close()
+	var zero T
+	p.item = zero
+	return false
+}
+
+// Returns the items of the given page, and starts prefetching the following
+// pages after the first one.
+func (p *Pager[T]) fetchPage(page int) ([]T, error) {
+	if p.ahead != nil {
+		return p.ahead.take(page)
+	}
+	items, pages, err := p.fetch(p.ctx, page)
+	if err != nil {
+		return nil, err
+	}
+	p.pages = pages
+	if page == 1 && p.Prefetch > 1 && !p.sequential && pages > 1 && len(items) > 0 {
+		p.ahead = startPrefetch(p.ctx, p.Prefetch, 2, pages, p.fetch)
+	}
+	return items, nil
+}
+
+// Stops fetching pages in the background.  Only needed for a Pager with
+// Prefetch set that is abandoned before Next returns false.
+func (p *Pager[T]) Close() {
+	if p.ahead != nil {
+		p.ahead.cancel()
+	}
+}
+
+// Returns the item found by the last call to Next.
+func (p *Pager[T]) Item() T {
+	return p.item
+}
+
+// Returns the error that stopped the iteration, if any.  A cancelled context
+// is reported as its error.
+func (p *Pager[T]) Err() error {
+	return p.err
+}
+
+// Returns a Pager over the photos matching params.  params.Page is ignored.
+// Flickr returns at most 4000 results for a search, so paging stops at the
+// page holding the last of them whatever page count Flickr reports; see
+// CompleteSearch for getting every result.
+func (c *Client) PhotosSearchPager(ctx context.Context, params PhotosSearchParams) *Pager[Photo] {
+	limit := searchPageLimit(params.PerPage)
+	return newPager(ctx, func(p Photo) string { return p.ID },
+		func(ctx context.Context, page int) ([]Photo, int, error) {
+			q := params
+			q.Page = page
+			r, err := c.PhotosSearchContext(ctx, q)
+			if err != nil {
+				return nil, 0, err
+			}
+			return r.Photos, min(r.Pages, limit), nil
+		})
+}
+
+// Returns a Pager over the contacts of the user in params.  params.Page is
+// ignored.
+func (c *Client) ContactsGetPublicListPager(ctx context.Context, params ContactsGetPublicListParams) *Pager[User] {
+	return newPager(ctx, func(u User) string { return u.NSID },
+		func(ctx context.Context, page int) ([]User, int, error) {
+			q := params
+			q.Page = page
+			r, err := c.ContactsGetPublicListContext(ctx, q)
+			if err != nil {
+				return nil, 0, err
+			}
+			return r.Contacts, r.Pages, nil
+		})
+}
+
+// Returns a Pager over the people who faved the photo in params.  params.Page
+// is ignored.
+func (c *Client) PhotosGetFavoritesPager(ctx context.Context, params PhotosGetFavoritesParams) *Pager[FavoritePerson] {
+	return newPager(ctx, func(f FavoritePerson) string { return f.NSID },
+		func(ctx context.Context, page int) ([]FavoritePerson, int, error) {
+			q := params
+			q.Page = page
+			r, err := c.PhotosGetFavoritesContext(ctx, q)
+			if err != nil {
+				return nil, 0, err
+			}
+			return r.Favorites, r.Pages, nil
+		})
+}
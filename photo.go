@@ -3,7 +3,11 @@
 package flickgo
 
 import (
+	"encoding/xml"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Image sizes supported by Flickr.  See
@@ -39,9 +43,72 @@ type ContactsGetPublicListResponse struct {
 type User struct {
 	UserName string `xml:"username,attr"`
 	NSID     string `xml:"nsid,attr"`
+	FullName string `xml:"fullname,attr"`
 }
 
-// Represents a Flickr photo.
+// Extra information that searches and other photo lists can return for each
+// photo.  See Photo for the fields each one fills in.
+type Extra string
+
+const (
+	ExtraDescription    Extra = "description"
+	ExtraLicense        Extra = "license"
+	ExtraDateUpload     Extra = "date_upload"
+	ExtraDateTaken      Extra = "date_taken"
+	ExtraOwnerName      Extra = "owner_name"
+	ExtraIconServer     Extra = "icon_server"
+	ExtraOriginalFormat Extra = "original_format"
+	ExtraLastUpdate     Extra = "last_update"
+	ExtraGeo            Extra = "geo"
+	ExtraTags           Extra = "tags"
+	ExtraMachineTags    Extra = "machine_tags"
+	ExtraODims          Extra = "o_dims"
+	ExtraViews          Extra = "views"
+	ExtraMedia          Extra = "media"
+	ExtraPathAlias      Extra = "path_alias"
+	ExtraURLSq          Extra = "url_sq"
+	ExtraURLT           Extra = "url_t"
+	ExtraURLS           Extra = "url_s"
+	ExtraURLQ           Extra = "url_q"
+	ExtraURLM           Extra = "url_m"
+	ExtraURLN           Extra = "url_n"
+	ExtraURLZ           Extra = "url_z"
+	ExtraURLC           Extra = "url_c"
+	ExtraURLL           Extra = "url_l"
+	ExtraURLO           Extra = "url_o"
+)
+
+// A set of extras, for the extras arguments of Flickr methods:
+//
+//	params.Extras = flickgo.Extras{flickgo.ExtraDateTaken, flickgo.ExtraURLM}.String()
+type Extras []Extra
+
+// Every extra that returns a URL.
+var ExtrasURLs = Extras{ExtraURLSq, ExtraURLT, ExtraURLS, ExtraURLQ, ExtraURLM,
+	ExtraURLN, ExtraURLZ, ExtraURLC, ExtraURLL, ExtraURLO}
+
+// Returns the extras as a comma-separated list, without duplicates.
+func (e Extras) String() string {
+	seen := make(map[Extra]bool)
+	var s []string
+	for _, x := range e {
+		if x != "" && !seen[x] {
+			seen[x] = true
+			s = append(s, string(x))
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// URL and dimensions of a photo in one size.
+type PhotoSize struct {
+	URL    string
+	Width  int
+	Height int
+}
+
+// Represents a Flickr photo.  Besides the basic fields, each extra requested
+// fills in the fields noted next to them.
 type Photo struct {
 	ID       string `xml:"id,attr"`
 	Owner    string `xml:"owner,attr"`
@@ -54,6 +121,82 @@ type Photo struct {
 	HeightT  string `xml:"height_t,attr"`
 	// Photo's aspect ratio: width divided by height.
 	Ratio float64
+
+	Description string `xml:"description"`  // ExtraDescription
+	License     string `xml:"license,attr"` // ExtraLicense
+
+	DateUpload UnixTime `xml:"dateupload,attr"` // ExtraDateUpload
+	LastUpdate UnixTime `xml:"lastupdate,attr"` // ExtraLastUpdate
+
+	// ExtraDateTaken.  Flickr does not know the time zone of taken dates,
+	// so they are returned as UTC.  Granularity is 0 for dates exact to the
+	// second, 4 for the month, 6 for the year and 8 for "circa".
+	DateTaken            FlickrTime `xml:"datetaken,attr"`
+	DateTakenGranularity int        `xml:"datetakengranularity,attr"`
+	DateTakenUnknown     int        `xml:"datetakenunknown,attr"`
+
+	OwnerName  string `xml:"ownername,attr"`  // ExtraOwnerName
+	IconServer string `xml:"iconserver,attr"` // ExtraIconServer
+	IconFarm   string `xml:"iconfarm,attr"`   // ExtraIconServer
+	PathAlias  string `xml:"pathalias,attr"`  // ExtraPathAlias
+
+	// ExtraOriginalFormat.
+	OriginalSecret string `xml:"originalsecret,attr"`
+	OriginalFormat string `xml:"originalformat,attr"`
+
+	// ExtraGeo.  Accuracy is 0 for photos that are not geotagged.
+	Latitude  float64 `xml:"latitude,attr"`
+	Longitude float64 `xml:"longitude,attr"`
+	Accuracy  int     `xml:"accuracy,attr"`
+	Context   int     `xml:"context,attr"`
+	PlaceID   string  `xml:"place_id,attr"`
+	WoeID     string  `xml:"woeid,attr"`
+
+	Tags        TagList `xml:"tags,attr"`         // ExtraTags
+	MachineTags TagList `xml:"machine_tags,attr"` // ExtraMachineTags
+
+	// ExtraODims.
+	OriginalWidth  int `xml:"o_width,attr"`
+	OriginalHeight int `xml:"o_height,attr"`
+
+	Views int    `xml:"views,attr"` // ExtraViews
+	Media string `xml:"media,attr"` // ExtraMedia: "photo" or "video"
+
+	// Sizes requested with the url extras, by the suffix of the extra; e.g.
+	// ExtraURLM is stored as "m".
+	Sizes map[string]PhotoSize `xml:"-"`
+}
+
+// Decodes the attributes of a photo element, including the url, width and
+// height extras of each size.
+func (p *Photo) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	// photo has Photo's fields but not this method.
+	type photo Photo
+	if err := d.DecodeElement((*photo)(p), &start); err != nil {
+		return err
+	}
+	attrs := make(map[string]string)
+	for _, a := range start.Attr {
+		attrs[a.Name.Local] = a.Value
+	}
+	p.unmarshalAttrs(attrs)
+	return nil
+}
+
+// Sets p.Sizes from the url_*, width_* and height_* attributes.
+func (p *Photo) unmarshalAttrs(attrs map[string]string) {
+	for k, v := range attrs {
+		if !strings.HasPrefix(k, "url_") || v == "" {
+			continue
+		}
+		size := strings.TrimPrefix(k, "url_")
+		w, _ := strconv.Atoi(attrs["width_"+size])
+		h, _ := strconv.Atoi(attrs["height_"+size])
+		if p.Sizes == nil {
+			p.Sizes = make(map[string]PhotoSize)
+		}
+		p.Sizes[size] = PhotoSize{URL: v, Width: w, Height: h}
+	}
 }
 
 // Returns the URL to this photo in the specified size.
@@ -66,10 +209,117 @@ func (p *Photo) URL(size string) string {
 		p.Farm, p.Server, p.ID, p.Secret, size)
 }
 
+// Time that Flickr sends as a Unix timestamp.  The zero UnixTime stands for
+// a missing timestamp.
+type UnixTime struct {
+	time.Time
+}
+
+func (t *UnixTime) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if s == "" || s == "0" {
+		t.Time = time.Time{}
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", s)
+	}
+	t.Time = time.Unix(n, 0).UTC()
+	return nil
+}
+
+// Time that Flickr sends in MySQL's datetime format, such as
+// "2006-01-02 15:04:05".  The zero FlickrTime stands for a missing time.
+type FlickrTime struct {
+	time.Time
+}
+
+func (t *FlickrTime) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if s == "" || strings.HasPrefix(s, "0000-00-00") {
+		t.Time = time.Time{}
+		return nil
+	}
+	v, err := time.Parse("2006-01-02 15:04:05", s)
+	if err != nil {
+		return fmt.Errorf("invalid date %q", s)
+	}
+	t.Time = v
+	return nil
+}
+
+// Space-separated list of tags.
+type TagList []string
+
+func (l *TagList) UnmarshalText(text []byte) error {
+	*l = strings.Fields(string(text))
+	return nil
+}
+
+// A photoset (album).  Owner and UserName are only set by
+// flickr.photosets.getInfo.
 type PhotoSet struct {
 	ID          string `xml:"id,attr"`
 	Title       string `xml:"title"`
 	Description string `xml:"description"`
+	Owner       string `xml:"owner,attr"`
+	UserName    string `xml:"username,attr"`
+
+	// URL of the set's page.  Only set by flickr.photosets.create.
+	URL string `xml:"url,attr"`
+
+	// The set's cover photo.
+	Primary string `xml:"primary,attr"`
+	Secret  string `xml:"secret,attr"`
+	Server  string `xml:"server,attr"`
+	Farm    string `xml:"farm,attr"`
+
+	Photos        int `xml:"photos,attr"`
+	Videos        int `xml:"videos,attr"`
+	CountViews    int `xml:"count_views,attr"`
+	CountComments int `xml:"count_comments,attr"`
+	CanComment    int `xml:"can_comment,attr"`
+
+	DateCreate UnixTime `xml:"date_create,attr"`
+	DateUpdate UnixTime `xml:"date_update,attr"`
+
+	// Extras of the primary photo requested with PrimaryPhotoExtras.
+	PrimaryPhotoExtras Photo `xml:"primary_photo_extras"`
+}
+
+// Returns the URL of the set's primary photo in the specified size.
+func (s *PhotoSet) PrimaryURL(size string) string {
+	p := Photo{ID: s.Primary, Secret: s.Secret, Server: s.Server, Farm: s.Farm}
+	return p.URL(size)
+}
+
+// Response for flickr.photosets.getList requests.
+type PhotosetsGetListResponse struct {
+	Page    int `xml:"page,attr"`
+	Pages   int `xml:"pages,attr"`
+	PerPage int `xml:"perpage,attr"`
+	Total   int `xml:"total,attr"`
+
+	// Whether the user may create more sets.
+	CanCreate int `xml:"cancreate,attr"`
+
+	Photosets []PhotoSet `xml:"photoset"`
+}
+
+// Response for flickr.photosets.getPhotos requests.
+type PhotosetPhotosResponse struct {
+	ID        string `xml:"id,attr"`
+	Primary   string `xml:"primary,attr"`
+	Owner     string `xml:"owner,attr"`
+	OwnerName string `xml:"ownername,attr"`
+	Title     string `xml:"title,attr"`
+
+	Page    int     `xml:"page,attr"`
+	Pages   int     `xml:"pages,attr"`
+	PerPage int     `xml:"perpage,attr"`
+	Total   int     `xml:"total,attr"`
+	Photos  []Photo `xml:"photo"`
 }
 
 type PhotoInfoResponse struct {
@@ -119,6 +369,7 @@ type PhotoFavoritesResponse struct {
 	Server  string `xml:"server,attr"`
 	Farm    string `xml:"farm,attr"`
 	Page    int    `xml:"page,attr"`
+	Pages   int    `xml:"pages,attr"`
 	PerPage int    `xml:"per_page,attr"`
 	Total   int    `xml:"total,attr"`
 
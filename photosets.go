@@ -0,0 +1,343 @@
+package flickgo
+
+import (
+	"context"
+	"strings"
+)
+
+type PhotosetsGetListParams struct {
+	// The NSID of the user to get a photoset list for. If none is specified, the calling user is assumed.
+	UserID string `mapper:"user_id"`
+
+	// The page of results to get. Currently, if this is not provided, all sets are returned, but this behaviour may change in future.
+	Page int `mapper:"page"`
+
+	// The number of sets to get per page. If paging is enabled, the maximum number of sets per page is 500.
+	PerPage int `mapper:"per_page"`
+
+	// A comma-delimited list of extra information to fetch for the primary photo. Currently supported fields are: license, date_upload, date_taken, owner_name, icon_server, original_format, last_update, geo, tags, machine_tags, o_dims, views, media, path_alias, url_sq, url_t, url_s, url_m, url_o
+	PrimaryPhotoExtras string `mapper:"primary_photo_extras"`
+
+	// A comma-separated list of photo ids. If specified, each returned set will include a list of these photo ids that are present in the set as "has_requested_photos"
+	PhotoIDs string `mapper:"photo_ids"`
+}
+
+// Returns the list of photo sets of the specified user.
+func (c *Client) GetSets(userID string) ([]PhotoSet, error) {
+	return c.GetSetsContext(context.Background(), userID)
+}
+
+// Same as GetSets, but ctx controls cancellation of the call.
+func (c *Client) GetSetsContext(ctx context.Context, userID string) ([]PhotoSet, error) {
+	r, err := c.PhotosetsGetListContext(ctx, PhotosetsGetListParams{UserID: userID})
+	if err != nil {
+		return nil, err
+	}
+	return r.Photosets, nil
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.getList.html
+func (c *Client) PhotosetsGetList(params PhotosetsGetListParams) (*PhotosetsGetListResponse, error) {
+	return c.PhotosetsGetListContext(context.Background(), params)
+}
+
+// Same as PhotosetsGetList, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsGetListContext(ctx context.Context, params PhotosetsGetListParams) (*PhotosetsGetListResponse, error) {
+	r := struct {
+		apiStatus
+		Sets PhotosetsGetListResponse `xml:"photosets"`
+	}{}
+	if err := flickrCall(ctx, c, "flickr.photosets.getList", StructToMap(params), &r); err != nil {
+		return nil, err
+	}
+	return &r.Sets, nil
+}
+
+type PhotosetsGetInfoParams struct {
+	// The ID of the photoset to fetch information for.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// The user_id here is the owner of the set passed in photoset_id.
+	UserID string `mapper:"user_id"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.getInfo.html
+func (c *Client) PhotosetsGetInfo(params PhotosetsGetInfoParams) (*PhotoSet, error) {
+	return c.PhotosetsGetInfoContext(context.Background(), params)
+}
+
+// Same as PhotosetsGetInfo, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsGetInfoContext(ctx context.Context, params PhotosetsGetInfoParams) (*PhotoSet, error) {
+	r := struct {
+		apiStatus
+		Set PhotoSet `xml:"photoset"`
+	}{}
+	if err := flickrCall(ctx, c, "flickr.photosets.getInfo", StructToMap(params), &r); err != nil {
+		return nil, err
+	}
+	return &r.Set, nil
+}
+
+type PhotosetsGetPhotosParams struct {
+	// The id of the photoset to return the photos for.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// The user_id here is the owner of the set passed in photoset_id.
+	UserID string `mapper:"user_id"`
+
+	// A comma-delimited list of extra information to fetch for each returned record. Currently supported fields are: license, date_upload, date_taken, owner_name, icon_server, original_format, last_update, geo, tags, machine_tags, o_dims, views, media, path_alias, url_sq, url_t, url_s, url_m, url_o
+	Extras string `mapper:"extras"`
+
+	// Return photos only matching a certain privacy level. This only applies when making an authenticated call to view a photoset you own. Valid values are:
+	// 1 public photos
+	// 2 private photos visible to friends
+	// 3 private photos visible to family
+	// 4 private photos visible to friends & family
+	// 5 completely private photos
+	PrivacyFilter int `mapper:"privacy_filter"`
+
+	// Number of photos to return per page. If this argument is omitted, it defaults to 500. The maximum allowed value is 500.
+	PerPage int `mapper:"per_page"`
+
+	// The page of results to return. If this argument is omitted, it defaults to 1.
+	Page int `mapper:"page"`
+
+	// Filter results by media type. Possible values are all (default), photos or videos
+	Media string `mapper:"media"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.getPhotos.html
+func (c *Client) PhotosetsGetPhotos(params PhotosetsGetPhotosParams) (*PhotosetPhotosResponse, error) {
+	return c.PhotosetsGetPhotosContext(context.Background(), params)
+}
+
+// Same as PhotosetsGetPhotos, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsGetPhotosContext(ctx context.Context, params PhotosetsGetPhotosParams) (*PhotosetPhotosResponse, error) {
+	r := struct {
+		apiStatus
+		Set PhotosetPhotosResponse `xml:"photoset"`
+	}{}
+	if err := flickrCall(ctx, c, "flickr.photosets.getPhotos", StructToMap(params), &r); err != nil {
+		return nil, err
+	}
+	return &r.Set, nil
+}
+
+type PhotosetsCreateParams struct {
+	// A title for the photoset.
+	Title string `mapper:"title"`
+
+	// A description of the photoset. May contain limited html.
+	Description string `mapper:"description"`
+
+	// The id of the photo to represent this set. The photo must belong to the calling user.
+	PrimaryPhotoID string `mapper:"primary_photo_id"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.create.html
+//
+// Requires write permission.  Only ID and URL of the returned set are set.
+func (c *Client) PhotosetsCreate(params PhotosetsCreateParams) (*PhotoSet, error) {
+	return c.PhotosetsCreateContext(context.Background(), params)
+}
+
+// Same as PhotosetsCreate, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsCreateContext(ctx context.Context, params PhotosetsCreateParams) (*PhotoSet, error) {
+	r := struct {
+		apiStatus
+		Set PhotoSet `xml:"photoset"`
+	}{}
+	if err := flickrPostForm(ctx, c, "flickr.photosets.create", StructToMap(params), &r); err != nil {
+		return nil, err
+	}
+	return &r.Set, nil
+}
+
+type PhotosetsDeleteParams struct {
+	// The id of the photoset to delete. It must be owned by the calling user.
+	PhotosetID string `mapper:"photoset_id"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.delete.html
+//
+// Requires write permission.
+func (c *Client) PhotosetsDelete(params PhotosetsDeleteParams) error {
+	return c.PhotosetsDeleteContext(context.Background(), params)
+}
+
+// Same as PhotosetsDelete, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsDeleteContext(ctx context.Context, params PhotosetsDeleteParams) error {
+	return flickrPostForm(ctx, c, "flickr.photosets.delete", StructToMap(params), &struct{ apiStatus }{})
+}
+
+type PhotosetsEditMetaParams struct {
+	// The id of the photoset to modify.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// The new title for the photoset.
+	Title string `mapper:"title"`
+
+	// A description of the photoset. May contain limited html.
+	Description string `mapper:"description"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.editMeta.html
+//
+// Requires write permission.
+func (c *Client) PhotosetsEditMeta(params PhotosetsEditMetaParams) error {
+	return c.PhotosetsEditMetaContext(context.Background(), params)
+}
+
+// Same as PhotosetsEditMeta, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsEditMetaContext(ctx context.Context, params PhotosetsEditMetaParams) error {
+	return flickrPostForm(ctx, c, "flickr.photosets.editMeta", StructToMap(params), &struct{ apiStatus }{})
+}
+
+type PhotosetsEditPhotosParams struct {
+	// The id of the photoset to modify. The photoset must belong to the calling user.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// The id of the photo to use as the 'primary' photo for the set. This id must also be passed along in photo_ids list argument.
+	PrimaryPhotoID string `mapper:"primary_photo_id"`
+
+	// The ids of the photos for the set, in order.  Photos not listed are removed from the set.
+	PhotoIDs []string `mapper:"photo_ids"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.editPhotos.html
+//
+// Requires write permission.
+func (c *Client) PhotosetsEditPhotos(params PhotosetsEditPhotosParams) error {
+	return c.PhotosetsEditPhotosContext(context.Background(), params)
+}
+
+// Same as PhotosetsEditPhotos, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsEditPhotosContext(ctx context.Context, params PhotosetsEditPhotosParams) error {
+	args := StructToMap(params)
+	args["photo_ids"] = strings.Join(params.PhotoIDs, ",")
+	return flickrPostForm(ctx, c, "flickr.photosets.editPhotos", args, &struct{ apiStatus }{})
+}
+
+type PhotosetsAddPhotoParams struct {
+	// The id of the photoset to add a photo to.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// The id of the photo to add to the set.
+	PhotoID string `mapper:"photo_id"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.addPhoto.html
+//
+// Requires write permission.  Adding a photo that is already in the set fails
+// with ErrCodePhotoAlreadyInSet.
+func (c *Client) PhotosetsAddPhoto(params PhotosetsAddPhotoParams) error {
+	return c.PhotosetsAddPhotoContext(context.Background(), params)
+}
+
+// Same as PhotosetsAddPhoto, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsAddPhotoContext(ctx context.Context, params PhotosetsAddPhotoParams) error {
+	return flickrPostForm(ctx, c, "flickr.photosets.addPhoto", StructToMap(params), &struct{ apiStatus }{})
+}
+
+type PhotosetsRemovePhotoParams struct {
+	// The id of the photoset to remove a photo from.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// The id of the photo to remove from the set.
+	PhotoID string `mapper:"photo_id"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.removePhoto.html
+//
+// Requires write permission.
+func (c *Client) PhotosetsRemovePhoto(params PhotosetsRemovePhotoParams) error {
+	return c.PhotosetsRemovePhotoContext(context.Background(), params)
+}
+
+// Same as PhotosetsRemovePhoto, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsRemovePhotoContext(ctx context.Context, params PhotosetsRemovePhotoParams) error {
+	return flickrPostForm(ctx, c, "flickr.photosets.removePhoto", StructToMap(params), &struct{ apiStatus }{})
+}
+
+type PhotosetsRemovePhotosParams struct {
+	// The id of the photoset to remove photos from.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// The ids of the photos to remove from the set.
+	PhotoIDs []string `mapper:"photo_ids"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.removePhotos.html
+//
+// Requires write permission.
+func (c *Client) PhotosetsRemovePhotos(params PhotosetsRemovePhotosParams) error {
+	return c.PhotosetsRemovePhotosContext(context.Background(), params)
+}
+
+// Same as PhotosetsRemovePhotos, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsRemovePhotosContext(ctx context.Context, params PhotosetsRemovePhotosParams) error {
+	args := StructToMap(params)
+	args["photo_ids"] = strings.Join(params.PhotoIDs, ",")
+	return flickrPostForm(ctx, c, "flickr.photosets.removePhotos", args, &struct{ apiStatus }{})
+}
+
+type PhotosetsReorderPhotosParams struct {
+	// The id of the photoset to reorder. The photoset must belong to the calling user.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// Ordered list of photo ids. Photos that are not in the list will keep their original order.
+	PhotoIDs []string `mapper:"photo_ids"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.reorderPhotos.html
+//
+// Requires write permission.
+func (c *Client) PhotosetsReorderPhotos(params PhotosetsReorderPhotosParams) error {
+	return c.PhotosetsReorderPhotosContext(context.Background(), params)
+}
+
+// Same as PhotosetsReorderPhotos, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsReorderPhotosContext(ctx context.Context, params PhotosetsReorderPhotosParams) error {
+	args := StructToMap(params)
+	args["photo_ids"] = strings.Join(params.PhotoIDs, ",")
+	return flickrPostForm(ctx, c, "flickr.photosets.reorderPhotos", args, &struct{ apiStatus }{})
+}
+
+type PhotosetsOrderSetsParams struct {
+	// Ordered list of photoset IDs.  Sets not listed are placed after them.
+	PhotosetIDs []string `mapper:"photoset_ids"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.orderSets.html
+//
+// Requires write permission.
+func (c *Client) PhotosetsOrderSets(params PhotosetsOrderSetsParams) error {
+	return c.PhotosetsOrderSetsContext(context.Background(), params)
+}
+
+// Same as PhotosetsOrderSets, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsOrderSetsContext(ctx context.Context, params PhotosetsOrderSetsParams) error {
+	args := StructToMap(params)
+	args["photoset_ids"] = strings.Join(params.PhotosetIDs, ",")
+	return flickrPostForm(ctx, c, "flickr.photosets.orderSets", args, &struct{ apiStatus }{})
+}
+
+type PhotosetsSetPrimaryPhotoParams struct {
+	// The id of the photoset to set primary photo to.
+	PhotosetID string `mapper:"photoset_id"`
+
+	// The id of the photo to set as primary.
+	PhotoID string `mapper:"photo_id"`
+}
+
+// Implements https://www.flickr.com/services/api/flickr.photosets.setPrimaryPhoto.html
+//
+// Requires write permission.
+func (c *Client) PhotosetsSetPrimaryPhoto(params PhotosetsSetPrimaryPhotoParams) error {
+	return c.PhotosetsSetPrimaryPhotoContext(context.Background(), params)
+}
+
+// Same as PhotosetsSetPrimaryPhoto, but ctx controls cancellation of the call.
+func (c *Client) PhotosetsSetPrimaryPhotoContext(ctx context.Context, params PhotosetsSetPrimaryPhotoParams) error {
+	return flickrPostForm(ctx, c, "flickr.photosets.setPrimaryPhoto", StructToMap(params), &struct{ apiStatus }{})
+}
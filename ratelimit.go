@@ -0,0 +1,186 @@
+package flickgo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Number of requests Flickr allows per API key per hour.
+const HourlyLimit = 3600
+
+// Limits the rate of requests sent to Flickr.  Implementations must be safe
+// for concurrent use.  To share Flickr's hourly budget between processes,
+// implement RateLimiter on top of a shared store.
+type RateLimiter interface {
+	// Blocks until another request may be sent or ctx is done, in which case
+	// it returns ctx.Err().
+	Wait(ctx context.Context) error
+}
+
+// Token bucket RateLimiter.  The bucket holds up to burst tokens and is
+// refilled at rate tokens per second; every request takes one token.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// Replaced by tests.
+	now func() time.Time
+}
+
+// Creates a TokenBucket that allows rate requests per second on average and
+// bursts of up to burst requests.  The bucket starts full.  Panics if rate
+// is not positive, since such a bucket would never refill.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if !(rate > 0) {
+		panic(fmt.Sprintf("flickgo: non-positive token bucket rate %v", rate))
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// Returns a TokenBucket that keeps within HourlyLimit, allowing bursts of 5
+// requests.
+func NewDefaultRateLimiter() *TokenBucket {
+	return NewTokenBucket(float64(HourlyLimit)/3600, 5)
+}
+
+// Takes a token and returns how long the caller has to wait before using it.
+func (b *TokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Returns a token taken by reserve but not used.
+func (b *TokenBucket) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d := b.reserve()
+	if d == 0 {
+		return nil
+	}
+	if err := sleepContext(ctx, d); err != nil {
+		b.cancel()
+		return err
+	}
+	return nil
+}
+
+var (
+	sharedMu       sync.Mutex
+	sharedLimiters = make(map[string]RateLimiter)
+)
+
+// Returns a default RateLimiter shared by all callers passing the same API
+// key.  Assign it to Client.RateLimiter of every Client using apiKey in this
+// process to keep them within a common budget.
+func SharedRateLimiter(apiKey string) RateLimiter {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	l, ok := sharedLimiters[apiKey]
+	if !ok {
+		l = NewDefaultRateLimiter()
+		sharedLimiters[apiKey] = l
+	}
+	return l
+}
+
+// Requests made within the last hour.
+type Quota struct {
+	Used      int
+	Limit     int
+	Remaining int
+}
+
+// Counts requests in one-minute buckets covering the last hour.
+type quotaCounter struct {
+	mu      sync.Mutex
+	minutes [60]int64
+	counts  [60]int
+}
+
+func (q *quotaCounter) add(t time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := t.Unix() / 60
+	i := m % 60
+	if q.minutes[i] != m {
+		q.minutes[i] = m
+		q.counts[i] = 0
+	}
+	q.counts[i]++
+}
+
+func (q *quotaCounter) used(t time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := t.Unix() / 60
+	n := 0
+	for i := range q.minutes {
+		if q.minutes[i] > m-60 && q.minutes[i] <= m {
+			n += q.counts[i]
+		}
+	}
+	return n
+}
+
+// Returns the number of requests made in the last hour by c and the clients
+// sharing its rate limit state through WithUser.  Requests made by other
+// clients with the same API key are not included.
+func (c *Client) Quota() Quota {
+	used := c.quota.used(time.Now())
+	remaining := HourlyLimit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Quota{Used: used, Limit: HourlyLimit, Remaining: remaining}
+}
+
+// Blocks until the rate limit allows another request or ctx is done, and
+// counts the request towards the hourly quota.
+func waitForLimit(ctx context.Context, c *Client) error {
+	if c.RateLimiter != nil {
+		if err := c.RateLimiter.Wait(ctx); err != nil {
+			return err
+		}
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.quota.add(time.Now())
+	return nil
+}
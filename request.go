@@ -2,36 +2,80 @@ package flickgo
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/xml"
-	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
+	"io/ioutil"
 	"net/http"
-	"net/textproto"
 	"net/url"
-	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Flickr's own endpoints, used for the empty fields of Client.Endpoints.
 const (
-	service   = "https://api.flickr.com/services"
-	uploadURL = "https://api.flickr.com/services/upload"
+	flickrRESTURL    = "https://api.flickr.com/services/rest/"
+	flickrOAuthURL   = "https://www.flickr.com/services/oauth"
+	flickrUploadURL  = "https://api.flickr.com/services/upload"
+	flickrReplaceURL = "https://api.flickr.com/services/replace"
 )
 
-// Returns all keys of map m.
-func keys(m map[string]string) sort.StringSlice {
-	ks := make([]string, len(m))
-	i := 0
-	for k := range m {
-		ks[i] = k
-		i++
+// URLs that a Client sends requests to.  Setting these points the client at
+// a test server or a gateway that accepts Flickr requests.  Requests are
+// signed for the URL they are sent to; to relay requests through a proxy
+// unchanged, set the Proxy of the http.Client's transport instead.
+type Endpoints struct {
+	// URL of the REST API, e.g. "https://api.flickr.com/services/rest/".
+	REST string
+
+	// Base URL of the OAuth endpoints; request_token, authorize and
+	// access_token are appended to it.  E.g.
+	// "https://www.flickr.com/services/oauth".
+	OAuth string
+
+	// URL for photo uploads, e.g. "https://api.flickr.com/services/upload".
+	Upload string
+
+	// URL for replacing photos, e.g.
+	// "https://api.flickr.com/services/replace".
+	Replace string
+}
+
+// Returns the URL of the REST API.
+func (c *Client) restURL() string {
+	if c.Endpoints.REST != "" {
+		return c.Endpoints.REST
+	}
+	return flickrRESTURL
+}
+
+// Returns the URL of the given OAuth endpoint.
+func (c *Client) oauthEndpoint(name string) string {
+	if c.Endpoints.OAuth != "" {
+		return strings.TrimSuffix(c.Endpoints.OAuth, "/") + "/" + name
+	}
+	return flickrOAuthURL + "/" + name
+}
+
+// Returns the URL for photo uploads.
+func (c *Client) uploadURL() string {
+	if c.Endpoints.Upload != "" {
+		return c.Endpoints.Upload
+	}
+	return flickrUploadURL
+}
+
+// Returns the URL for replacing photos.
+func (c *Client) replaceURL() string {
+	if c.Endpoints.Replace != "" {
+		return c.Endpoints.Replace
 	}
-	return ks
+	return flickrReplaceURL
 }
 
 // Creates a new http.Values and copies values from m into it.
@@ -52,14 +96,52 @@ func clone(m map[string]string) map[string]string {
 	return r
 }
 
+// Returns an error that prefixes err's message with msg.  err stays in the
+// chain for errors.Is and errors.As.
 func wrapErr(msg string, err error) error {
-	return errors.New(msg + ": " + err.Error())
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// Returns a URL for invoking a Flickr method with the specified arguments.  If
+// authenticated is true, the URL is signed with OAuth using c.secret and the
+// credentials set by WithUser, if any.
+func makeURL(c *Client, method string, args map[string]string, authenticated bool) string {
+	if authenticated {
+		return oauthURL(c, method, args, c.creds.Token, c.creds.Secret)
+	}
+	return c.restURL() + "?" + queryValues(methodArgs(c, method, args)).Encode()
 }
 
-// Returns an API signature for the given arguments.
-func sign(secret string, args map[string]string) string {
-	ks := keys(args)
-	ks.Sort()
+// Returns a copy of args with the arguments every REST call takes added.
+func methodArgs(c *Client, method string, args map[string]string) map[string]string {
+	a := clone(args)
+	a["method"] = method
+	a["api_key"] = c.apiKey
+	if c.Format == FormatJSON {
+		a["format"] = "json"
+		a["nojsoncallback"] = "1"
+	}
+	return a
+}
+
+// Returns a URL for invoking a Flickr method, signed with OAuth using the
+// given token and token secret.
+func oauthURL(c *Client, method string, args map[string]string,
+	token string, tokenSecret string) string {
+	a := methodArgs(c, method, args)
+	u := c.restURL()
+	a = oauthArgs(c, "GET", u, a, token, tokenSecret)
+	return u + "?" + queryValues(a).Encode()
+}
+
+// Returns an API signature for the given arguments using the legacy,
+// pre-OAuth signing scheme.
+func legacySign(secret string, args map[string]string) string {
+	ks := make([]string, 0, len(args))
+	for k := range args {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
 	m := md5.New()
 	m.Write([]byte(secret))
 	for _, k := range ks {
@@ -68,34 +150,13 @@ func sign(secret string, args map[string]string) string {
 	return fmt.Sprintf("%x", m.Sum(nil))
 }
 
-// Returns a signed URL.  path should be "auth" for auth requests and "rest"
-// for all other requests.  args specifies the query arguments.  Signing of the
-// URL is done by adding "api_sig" argument to the query string, whose value is
-// derived by signing the query values with secret.
-func signedURL(secret string, apiKey string, path string, args map[string]string) string {
-	a := clone(args)
-	a["api_key"] = apiKey
-	a["api_sig"] = sign(secret, a)
-	qry := queryValues(a).Encode()
-	return fmt.Sprintf("%s/%s/?%s", service, path, qry)
-}
-
-// Returns a URL for invoking a Flickr method with the specified arguments.  If
-// c has its AuthToken field set, the auth token is added to the URL.  Returned
-// URL is always signed with c.secret.
-func makeURL(c *Client, method string, args map[string]string, authenticated bool) string {
-	a := clone(args)
-	a["method"] = method
-	a["api_key"] = c.apiKey
-	var u string
-	if authenticated {
-		a["auth_token"] = c.AuthToken
-		u = signedURL(c.secret, c.apiKey, "rest", a)
-	} else {
-		qry := queryValues(a).Encode()
-		u = fmt.Sprintf("%s/rest/?%s", service, qry)
-	}
-	return u
+// Returns a URL for invoking a Flickr method on behalf of the holder of a
+// legacy auth token.  Flickr only accepts these for migrating to OAuth.
+func legacyURL(c *Client, method string, args map[string]string, authToken string) string {
+	a := methodArgs(c, method, args)
+	a["auth_token"] = authToken
+	a["api_sig"] = legacySign(c.secret, a)
+	return c.restURL() + "?" + queryValues(a).Encode()
 }
 
 // Regular expressions for identifying non-JSON part of the JSONP response
@@ -112,139 +173,219 @@ func extractJSON(jsonp []byte) []byte {
 	return end.ReplaceAll(t, empty)
 }
 
-// Processes a response and returns JSON content from it.
-func processReponse(c *Client, r *http.Response) (io.ReadCloser, error) {
-	// TODO: handle error response codes like 401 and 500.
+// Maximum number of body bytes kept in an HTTPError.
+const errorBodyLimit = 512
 
-	return r.Body, nil
+// Processes a response and returns its body.  Responses with a non-2xx status
+// are returned as *HTTPError, with the body closed.
+func processReponse(c *Client, r *http.Response) (io.ReadCloser, error) {
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return r.Body, nil
+	}
+	defer r.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, errorBodyLimit))
+	return nil, &HTTPError{
+		StatusCode: r.StatusCode,
+		Status:     r.Status,
+		Header:     r.Header,
+		RetryAfter: retryAfter(r.Header.Get("Retry-After"), time.Now()),
+		Body:       string(body),
+	}
 }
 
-func parseXML(in io.Reader, resp interface{}, logger Debugfer) error {
-	buf := bytes.NewBuffer(nil)
-	io.Copy(buf, in)
-	if logger != nil {
-		logger.Debugf("Parsing XML %s", string(buf.Bytes()))
+// Parses the value of a Retry-After header, which is either a number of
+// seconds or an HTTP date.  Returns 0 if v is empty or malformed.
+func retryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
 	}
-	if err := xml.NewDecoder(buf).Decode(resp); err != nil {
-		return wrapErr("XML parsing failed", err)
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
 	}
-	return nil
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
 }
 
-// Sends a GET request to u and returns the response JSON.
-func fetch(c *Client, u string) (io.ReadCloser, error) {
-	waitForLimit(c)
-	// fmt.Printf("Getting %s\n", u)
-	r, getErr := c.httpClient.Get(u)
-	if getErr != nil {
-		return nil, wrapErr("GET failed", getErr)
-	}
-	return processReponse(c, r)
+// Writer that keeps the first limit bytes written to it and discards the
+// rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
 }
 
-// Sends a Flickr request, parses the response XML, and populates values in
-// resp.  url represents the complete Flickr request with the arguments signed
-// with the API secret.
-func flickrGet(c *Client, url_ string, resp interface{}) error {
-	if c.Logger != nil {
-		c.Logger.Debugf("GET %v\n", url_)
-	}
-	in, err := fetch(c, url_)
-	if err != nil {
-		return err
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.Buffer.Write(p[:room])
+		b.truncated = true
+	} else {
+		b.Buffer.Write(p)
 	}
-	defer in.Close()
-	return parseXML(in, resp, c.Logger)
+	return len(p), nil
 }
 
-func flickrPost(c *Client, req *http.Request, resp interface{}) error {
-	if c.Logger != nil {
-		c.Logger.Debugf("POST %v\n", req.URL)
+func parseJSON(in io.Reader, resp interface{}) error {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return wrapErr("reading response failed", err)
 	}
-	waitForLimit(c)
-	r, rErr := c.httpClient.Do(req)
-	if rErr != nil {
-		return rErr
+	if err := decodeJSON(data, resp); err != nil {
+		return wrapErr("JSON parsing failed", err)
 	}
-	in, pErr := processReponse(c, r)
-	if pErr != nil {
-		return wrapErr("error response", pErr)
+	return nil
+}
+
+// Decodes XML from in as it is read, without buffering the whole response.
+func parseXML(in io.Reader, resp interface{}) error {
+	if err := xml.NewDecoder(in).Decode(resp); err != nil {
+		return wrapErr("XML parsing failed", err)
 	}
-	defer in.Close()
-	return parseXML(in, resp, c.Logger)
+	return nil
 }
 
-// Copied from mime/multipart/writer.go.
-func escapeQuotes(s string) string {
-	s = strings.Replace(s, "\\", "\\\\", -1)
-	s = strings.Replace(s, "\"", "\\\"", -1)
-	return s
+// Sends a GET request to u, once c.RateLimiter allows it, and returns the
+// response body.
+func fetch(ctx context.Context, c *Client, u string) (io.ReadCloser, error) {
+	if err := waitForLimit(ctx, c); err != nil {
+		return nil, err
+	}
+	return sendGet(ctx, c, u)
 }
 
-var contentType = map[string]string{
-	".jpg":  "image/jpeg",
-	".jpeg": "image/jpeg",
-	".jpe":  "image/jpeg",
-	".gif":  "image/gif",
-	".png":  "image/png",
+// Sends a GET request to u without waiting for c.RateLimiter and returns the
+// response body.
+func sendGet(ctx context.Context, c *Client, u string) (io.ReadCloser, error) {
+	req, rErr := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if rErr != nil {
+		return nil, wrapErr("request creation failed", rErr)
+	}
+	r, getErr := c.httpClient.Do(req)
+	if getErr != nil {
+		return nil, wrapErr("GET failed", getErr)
+	}
+	return processReponse(c, r)
 }
 
-func multipartWriter(w io.Writer, filename string, photo []byte,
-	args map[string]string) (*multipart.Writer, error) {
-	mpw := multipart.NewWriter(w)
-	for k, v := range args {
-		if err := mpw.WriteField(k, v); err != nil {
-			return nil, wrapErr(fmt.Sprintf("field write failed [%v=%v]", k, v), err)
-		}
+// Decodes a response in the given format into resp and returns the API error
+// it reports, if any.  The start of the body is logged if c.LogBodyLimit is
+// set.
+func parseResponse(c *Client, in io.Reader, format string, method string,
+	resp interface{}) error {
+	if c.Logger != nil && c.LogBodyLimit > 0 {
+		logged := &cappedBuffer{limit: c.LogBodyLimit}
+		in = io.TeeReader(in, logged)
+		defer func() {
+			if logged.truncated {
+				c.Logger.Debugf("Response body (truncated) %s", logged.String())
+			} else {
+				c.Logger.Debugf("Response body %s", logged.String())
+			}
+		}()
 	}
-	h := make(textproto.MIMEHeader)
-	h.Set("Content-Disposition",
-		fmt.Sprintf(`form-data; name="photo"; filename="%s"`,
-			escapeQuotes(filename)))
-	h.Set("Content-Type", contentType[strings.ToLower(filepath.Ext(filename))])
-	w, cErr := mpw.CreatePart(h)
-	if cErr != nil {
-		return nil, wrapErr("form file creation failed ["+filename+"]", cErr)
+	var err error
+	if format == FormatJSON {
+		err = parseJSON(in, resp)
+	} else {
+		err = parseXML(in, resp)
 	}
-	if _, err := w.Write(photo); err != nil {
-		return nil, wrapErr("adding photo data failed", err)
+	if err != nil {
+		return err
 	}
-	if err := mpw.Close(); err != nil {
-		return nil, wrapErr("multipart close failed", err)
+	if r, ok := resp.(apiResponse); ok && r.status().Stat != "ok" {
+		return r.status().Err.Err(method)
 	}
-	return mpw, nil
+	return nil
 }
 
-func uploadRequest(c *Client, filename string, photo []byte,
-	args map[string]string) (*http.Request, error) {
-	a := clone(args)
-	a["api_key"] = c.apiKey
-	a["auth_token"] = c.AuthToken
-	a["async"] = "1"
-	a["api_sig"] = sign(c.secret, a)
+// Sends a GET request for a Flickr method, parses the response, and
+// populates values in resp.  signedURL returns the complete request URL with
+// the arguments signed; it is called for every attempt so that each one carries
+// a fresh nonce and timestamp.  Failed calls are retried according to
+// c.Retry.
+func flickrGet(ctx context.Context, c *Client, method string, signedURL func() string,
+	resp interface{}) error {
+	return withRetry(ctx, c, c.Retry, method, resp, func() error {
+		if err := waitForLimit(ctx, c); err != nil {
+			return err
+		}
+		u := signedURL()
+		if c.Logger != nil {
+			c.Logger.Debugf("GET %v\n", u)
+		}
+		in, err := sendGet(ctx, c, u)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		return parseResponse(c, in, c.Format, method, resp)
+	})
+}
 
-	buf := bytes.NewBuffer(make([]byte, 0, len(photo)*2))
-	mpw, wErr := multipartWriter(buf, filename, photo, a)
-	if wErr != nil {
-		return nil, wrapErr("writer creation failed", wErr)
+// Invokes a Flickr method with a GET request signed with OAuth, and
+// populates resp from the response.
+func flickrCall(ctx context.Context, c *Client, method string, args map[string]string,
+	resp interface{}) error {
+	return flickrGet(ctx, c, method, func() string {
+		return makeURL(c, method, args, true)
+	}, resp)
+}
+
+// Sends a POST request and populates resp from the response, which is in the
+// given format.  method names the call for errors and RetryPolicy.Methods.
+// newRequest builds and signs the request; it is called for every attempt so
+// that each one carries a fresh nonce and timestamp.  Failed calls are
+// retried according to c.Retry if replayable is set.
+func flickrPost(ctx context.Context, c *Client, method string, replayable bool,
+	newRequest func() (*http.Request, error), format string, resp interface{}) error {
+	p := c.Retry
+	if !replayable {
+		p = nil
 	}
+	return withRetry(ctx, c, p, method, resp, func() error {
+		if err := waitForLimit(ctx, c); err != nil {
+			return err
+		}
+		req, err := newRequest()
+		if err != nil {
+			return err
+		}
+		if c.Logger != nil {
+			c.Logger.Debugf("POST %v\n", req.URL)
+		}
+		r, rErr := c.httpClient.Do(req.WithContext(ctx))
+		if rErr != nil {
+			return wrapErr("POST failed", rErr)
+		}
+		in, pErr := processReponse(c, r)
+		if pErr != nil {
+			return pErr
+		}
+		defer in.Close()
+		return parseResponse(c, in, format, method, resp)
+	})
+}
 
-	req, rErr := http.NewRequest("POST", uploadURL, buf)
-	if rErr != nil {
-		return nil, wrapErr("request creation failed", rErr)
+// Returns a POST request invoking a Flickr method with the specified
+// arguments as a form, signed with OAuth using c.secret and the credentials
+// set by WithUser.
+func postRequest(c *Client, method string, args map[string]string) (*http.Request, error) {
+	u := c.restURL()
+	a := oauthArgs(c, "POST", u, methodArgs(c, method, args), c.creds.Token, c.creds.Secret)
+	req, err := http.NewRequest("POST", u, strings.NewReader(queryValues(a).Encode()))
+	if err != nil {
+		return nil, wrapErr("request creation failed", err)
 	}
-	req.Header.Set("Content-Type", mpw.FormDataContentType())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	return req, nil
 }
 
-func waitForLimit(c *Client) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	now := time.Now()
-	if c.lastRequest.Add(requestPeriod).Before(now) {
-		c.lastRequest = now
-		return
-	}
-	time.Sleep(now.Sub(c.lastRequest))
-	c.lastRequest = now
+// Invokes a Flickr method that changes data with a signed POST request, and
+// populates resp from the response.
+func flickrPostForm(ctx context.Context, c *Client, method string, args map[string]string,
+	resp interface{}) error {
+	return flickrPost(ctx, c, method, true, func() (*http.Request, error) {
+		return postRequest(c, method, args)
+	}, c.Format, resp)
 }
@@ -0,0 +1,138 @@
+package flickgo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Controls how calls failing with temporary errors are retried.  See
+// IsRetryable for the errors that are considered temporary.  Calls that fail
+// to reach Flickr or to read its response, other than by ctx being done, are
+// retried as well.
+type RetryPolicy struct {
+	// Maximum number of attempts per call, including the first one.  Values
+	// below 2 disable retries.
+	MaxAttempts int
+
+	// Delay before the first retry.  The delay doubles with every further
+	// retry, and a random amount of up to half of it is taken off to keep
+	// clients from retrying in lockstep.  A Retry-After header sent by Flickr
+	// takes precedence when it asks for a longer delay.
+	BaseDelay time.Duration
+
+	// Upper bound on the delay computed from BaseDelay.  Zero means no bound.
+	MaxDelay time.Duration
+
+	// Overrides, per Flickr method name, whether calls are retried.  By
+	// default only read methods (flickr.*.get*, search*, find*, lookup* and
+	// check*) are retried, since retrying a write whose response was lost
+	// could apply it twice.  Uploads use the method names "upload" and
+	// "replace".
+	Methods map[string]bool
+}
+
+// Returns a policy that makes up to 4 attempts, waiting about 1, 2 and 4
+// seconds between them.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+	}
+}
+
+// Prefixes of the names of methods that do not modify anything.
+var readMethodPrefixes = []string{"get", "search", "find", "lookup", "check"}
+
+// Reports whether calls to method may be retried.
+func (p *RetryPolicy) retries(method string) bool {
+	if v, ok := p.Methods[method]; ok {
+		return v
+	}
+	if method == "flickr.auth.oauth.getAccessToken" {
+		// Invalidates the legacy token it is called with.
+		return false
+	}
+	name := method[strings.LastIndex(method, ".")+1:]
+	if name == method {
+		return false
+	}
+	for _, prefix := range readMethodPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how long to wait after the given attempt (1 for the first one)
+// failed with err.
+func (p *RetryPolicy) delay(attempt int, err error) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay == 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d > 0 {
+		d -= time.Duration(rand.Int63n(int64(d)/2 + 1))
+	}
+	var h *HTTPError
+	if errors.As(err, &h) && h.RetryAfter > d {
+		d = h.RetryAfter
+	}
+	return d
+}
+
+// Waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reports whether err is a network failure sending a request or reading its
+// response, rather than an error returned by Flickr or a cancellation.
+func isTransportError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var n net.Error
+	return errors.As(err, &n) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Invokes call, which populates resp, until it succeeds or fails with an
+// error p does not allow retrying.  resp is reset before every retry.  A nil
+// p means no retries.
+func withRetry(ctx context.Context, c *Client, p *RetryPolicy, method string,
+	resp interface{}, call func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || p == nil || attempt >= p.MaxAttempts ||
+			!p.retries(method) || !(IsRetryable(err) || isTransportError(err)) {
+			return err
+		}
+		d := p.delay(attempt, err)
+		if c.Logger != nil {
+			c.Logger.Debugf("%s: attempt %d of %d failed, retrying in %v: %v\n",
+				method, attempt, p.MaxAttempts, d, err)
+		}
+		if err := sleepContext(ctx, d); err != nil {
+			return err
+		}
+		v := reflect.ValueOf(resp).Elem()
+		v.Set(reflect.Zero(v.Type()))
+	}
+}
@@ -0,0 +1,616 @@
+package flickgo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flickr returns no more than this many results for a search, however many
+// pages it reports.
+var searchResultLimit = 4000
+
+// Returns the number of pages that hold the results Flickr returns for a
+// search with the given page size, where 0 means Flickr's default of 100.
+func searchPageLimit(perPage int) int {
+	if perPage <= 0 {
+		perPage = 100
+	}
+	return (searchResultLimit + perPage - 1) / perPage
+}
+
+// Default minimum dates of CompleteSearch.  Nothing was uploaded to Flickr
+// before the Unix epoch, but scans of old photos can be dated long before it.
+var (
+	minUploadDate = time.Unix(0, 0)
+	minTakenDate  = time.Date(1800, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Date that CompleteSearch splits a search by.
+type DateField int
+
+const (
+	DateUploaded DateField = iota
+	DateTaken
+)
+
+// Inclusive range of dates, in whole seconds.
+type dateRange struct {
+	min, max time.Time
+}
+
+// Splits a search into date ranges that each match fewer photos than Flickr
+// returns, and pages through them one after the other.
+type rangeSearch struct {
+	c      *Client
+	params PhotosSearchParams
+	by     DateField
+
+	// Ranges not searched yet, in order.
+	ranges []dateRange
+
+	// Range being paged through, if any.
+	cur  *dateRange
+	page int
+
+	// IDs of the photos returned so far.
+	seen map[string]bool
+}
+
+// Returns a Pager over every photo matching params, working around Flickr's
+// limit of 4000 results per search.  The date range given by params for the
+// field by is split in halves until each part matches fewer photos than the
+// limit, and the parts are searched from the oldest to the newest.  A missing
+// minimum date defaults to the Unix epoch for DateUploaded and to 1 January
+// 1800 UTC for DateTaken, and a missing maximum date to now.  Photos from a
+// single second matching more than the limit are returned only up to it.
+// params.Page is ignored, and the Pager's Prefetch has no effect.
+func (c *Client) CompleteSearch(ctx context.Context, params PhotosSearchParams, by DateField) *Pager[Photo] {
+	min, max, defaultMin := params.MinUploadDate, params.MaxUploadDate, minUploadDate
+	if by == DateTaken {
+		min, max, defaultMin = params.MinTakenDate, params.MaxTakenDate, minTakenDate
+	}
+	if min.IsZero() {
+		min = defaultMin
+	}
+	if max.IsZero() {
+		max = time.Now()
+	}
+	if params.PerPage == 0 {
+		params.PerPage = 500
+	}
+	s := &rangeSearch{
+		c:      c,
+		params: params,
+		by:     by,
+		ranges: []dateRange{{time.Unix(min.Unix(), 0), time.Unix(max.Unix(), 0)}},
+		seen:   make(map[string]bool),
+	}
+	p := newPager(ctx, func(p Photo) string { return p.ID }, s.fetch)
+	p.sequential = true
+	return p
+}
+
+// Searches the given page of photos in r.
+func (s *rangeSearch) search(ctx context.Context, r dateRange, page int) (*SearchResponse, error) {
+	params := s.params
+	params.Page = page
+	if s.by == DateTaken {
+		params.MinTakenDate, params.MaxTakenDate = r.min, r.max
+	} else {
+		params.MinUploadDate, params.MaxUploadDate = r.min, r.max
+	}
+	return s.c.PhotosSearchContext(ctx, params)
+}
+
+// Returns the next page holding photos not returned yet; page counts the
+// pages returned so far.  The page count returned is page+1 while more pages
+// may follow.  A page holding only photos returned already ends its range,
+// but not the search.
+func (s *rangeSearch) fetch(ctx context.Context, page int) ([]Photo, int, error) {
+	for {
+		var r *SearchResponse
+		if s.cur == nil {
+			if len(s.ranges) == 0 {
+				return nil, page, nil
+			}
+			dr := s.ranges[0]
+			s.ranges = s.ranges[1:]
+			var err error
+			if r, err = s.search(ctx, dr, 1); err != nil {
+				return nil, 0, err
+			}
+			if r.Total >= searchResultLimit && dr.max.After(dr.min) {
+				mid := time.Unix(dr.min.Unix()+(dr.max.Unix()-dr.min.Unix())/2, 0)
+				s.ranges = append([]dateRange{{dr.min, mid}, {mid.Add(time.Second), dr.max}}, s.ranges...)
+				continue
+			}
+			s.cur, s.page = &dr, 1
+		} else {
+			s.page++
+			var err error
+			if r, err = s.search(ctx, *s.cur, s.page); err != nil {
+				return nil, 0, err
+			}
+		}
+		fresh := false
+		for _, p := range r.Photos {
+			if !s.seen[p.ID] {
+				s.seen[p.ID] = true
+				fresh = true
+			}
+		}
+		if s.page >= min(r.Pages, searchPageLimit(s.params.PerPage)) || !fresh {
+			s.cur = nil
+		}
+		if !fresh {
+			continue
+		}
+		pages := page
+		if s.cur != nil || len(s.ranges) > 0 {
+			pages++
+		}
+		return r.Photos, pages, nil
+	}
+}
+
+// How the tags or machine tags of a search are combined.
+type TagMode string
+
+const (
+	TagModeAny TagMode = "any"
+	TagModeAll TagMode = "all"
+)
+
+// Orders of search results.
+type SortOrder string
+
+const (
+	SortDatePostedAsc       SortOrder = "date-posted-asc"
+	SortDatePostedDesc      SortOrder = "date-posted-desc"
+	SortDateTakenAsc        SortOrder = "date-taken-asc"
+	SortDateTakenDesc       SortOrder = "date-taken-desc"
+	SortInterestingnessDesc SortOrder = "interestingness-desc"
+	SortInterestingnessAsc  SortOrder = "interestingness-asc"
+	SortRelevance           SortOrder = "relevance"
+)
+
+// Kinds of media a search returns.
+type MediaType string
+
+const (
+	MediaAll    MediaType = "all"
+	MediaPhotos MediaType = "photos"
+	MediaVideos MediaType = "videos"
+)
+
+// Units of the radius of a radial geo search.
+type RadiusUnits string
+
+const (
+	RadiusKilometers RadiusUnits = "km"
+	RadiusMiles      RadiusUnits = "mi"
+)
+
+// Privacy levels of the calling user's own photos to search.
+type PrivacyFilter int
+
+const (
+	PrivacyPublic        PrivacyFilter = 1
+	PrivacyFriends       PrivacyFilter = 2
+	PrivacyFamily        PrivacyFilter = 3
+	PrivacyFriendsFamily PrivacyFilter = 4
+	PrivacyPrivate       PrivacyFilter = 5
+)
+
+// Where geotagged photos were taken.
+type GeoContext int
+
+const (
+	GeoContextUndefined GeoContext = 0
+	GeoContextIndoors   GeoContext = 1
+	GeoContextOutdoors  GeoContext = 2
+)
+
+// Limits Flickr puts on searches.
+const (
+	maxSearchPerPage     = 500
+	maxSearchRadiusKm    = 32
+	maxSearchRadiusMi    = 20
+	maxMachineTagsAll    = 16
+	maxMachineTagsAny    = 8
+	maxLocationAccuracy  = 16
+	maxSearchContentType = 7
+)
+
+var (
+	sortOrders = map[SortOrder]bool{
+		SortDatePostedAsc: true, SortDatePostedDesc: true, SortDateTakenAsc: true,
+		SortDateTakenDesc: true, SortInterestingnessDesc: true,
+		SortInterestingnessAsc: true, SortRelevance: true,
+	}
+	mediaTypes = map[MediaType]bool{MediaAll: true, MediaPhotos: true, MediaVideos: true}
+)
+
+// Reports the problems with p that would make Flickr reject the search or
+// return something other than what was asked for, such as a geo search
+// without a limiting agent, which only returns photos from the last 12
+// hours.  Returns nil if there are none.
+func (p *PhotosSearchParams) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(p.PerPage >= 0 && p.PerPage <= maxSearchPerPage,
+		"per_page %d is not between 1 and %d", p.PerPage, maxSearchPerPage)
+	check(p.Page >= 0, "invalid page %d", p.Page)
+	for _, m := range []struct{ name, value string }{
+		{"tag_mode", p.TagMode}, {"machine_tag_mode", p.MachineTagMode}} {
+		check(m.value == "" || m.value == string(TagModeAny) || m.value == string(TagModeAll),
+			"invalid %s %q", m.name, m.value)
+	}
+	check(p.Sort == "" || sortOrders[SortOrder(p.Sort)], "invalid sort order %q", p.Sort)
+	check(p.Media == "" || mediaTypes[MediaType(p.Media)], "invalid media %q", p.Media)
+	check(p.HasGeo == "" || p.HasGeo == "0" || p.HasGeo == "1", "invalid has_geo %q", p.HasGeo)
+	check(p.GeoContext == "" || p.GeoContext == "0" || p.GeoContext == "1" || p.GeoContext == "2",
+		"invalid geo_context %q", p.GeoContext)
+	check(p.PrivacyFilter >= 0 && p.PrivacyFilter <= int(PrivacyPrivate),
+		"invalid privacy_filter %d", p.PrivacyFilter)
+	check(p.SafeSearch >= 0 && p.SafeSearch <= int(SafetyRestricted),
+		"invalid safe_search %d", p.SafeSearch)
+	check(p.ContentType >= 0 && p.ContentType <= maxSearchContentType,
+		"invalid content_type %d", p.ContentType)
+	check(p.Accuracy >= 0 && p.Accuracy <= maxLocationAccuracy,
+		"accuracy %d is not between 1 and %d", p.Accuracy, maxLocationAccuracy)
+	for _, r := range []struct {
+		name     string
+		min, max time.Time
+	}{{"upload", p.MinUploadDate, p.MaxUploadDate}, {"taken", p.MinTakenDate, p.MaxTakenDate}} {
+		check(r.min.IsZero() || r.max.IsZero() || !r.max.Before(r.min),
+			"max_%s_date %v is before min_%s_date %v", r.name, r.max, r.name, r.min)
+	}
+
+	if p.MachineTags != "" {
+		n := len(strings.Split(p.MachineTags, ","))
+		if p.MachineTagMode == string(TagModeAll) {
+			check(n <= maxMachineTagsAll, "%d machine tags given, but searches for all of them take at most %d",
+				n, maxMachineTagsAll)
+		} else {
+			check(n <= maxMachineTagsAny, "%d machine tags given, but searches for any of them take at most %d",
+				n, maxMachineTagsAny)
+		}
+	}
+
+	if p.BBox != "" {
+		if err := checkBBox(p.BBox); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := checkRadial(p); err != nil {
+		errs = append(errs, err)
+	}
+
+	geo := p.BBox != "" || p.Lat != "" || p.WoeID != "" || p.PlaceID != "" ||
+		p.HasGeo != "" || p.GeoContext != ""
+	limited := p.Tags != "" || p.Text != "" || p.MachineTags != "" || p.UserID != "" ||
+		p.GroupID != "" || !p.MinUploadDate.IsZero() || !p.MinTakenDate.IsZero()
+	check(!geo || limited, "geo searches need a limiting agent such as tags, text, a user, "+
+		"a group or a minimum date; without one Flickr only returns photos from the last 12 hours")
+	return errors.Join(errs...)
+}
+
+// Parses a coordinate and checks that it is within [-limit, limit].
+func parseCoordinate(name string, s string, limit float64) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	if f < -limit || f > limit {
+		return 0, fmt.Errorf("%s %v is not between %v and %v", name, f, -limit, limit)
+	}
+	return f, nil
+}
+
+// Checks a bounding box given as "min_lon,min_lat,max_lon,max_lat".
+func checkBBox(bbox string) error {
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return fmt.Errorf("bbox %q does not have 4 values", bbox)
+	}
+	var v [4]float64
+	for i, name := range []string{"bbox min longitude", "bbox min latitude",
+		"bbox max longitude", "bbox max latitude"} {
+		limit := 180.0
+		if i%2 == 1 {
+			limit = 90
+		}
+		var err error
+		if v[i], err = parseCoordinate(name, parts[i], limit); err != nil {
+			return err
+		}
+	}
+	if v[0] >= v[2] || v[1] >= v[3] {
+		return fmt.Errorf("bbox %q is not ordered min_lon,min_lat,max_lon,max_lat", bbox)
+	}
+	return nil
+}
+
+// Checks the arguments of a radial geo search.
+func checkRadial(p *PhotosSearchParams) error {
+	if p.Lat == "" && p.Lon == "" {
+		if p.Radius != "" || p.RadiusUnits != "" {
+			return errors.New("radius given without lat and lon")
+		}
+		return nil
+	}
+	if p.Lat == "" || p.Lon == "" {
+		return errors.New("lat and lon must be given together")
+	}
+	if _, err := parseCoordinate("lat", p.Lat, 90); err != nil {
+		return err
+	}
+	if _, err := parseCoordinate("lon", p.Lon, 180); err != nil {
+		return err
+	}
+	max := float64(maxSearchRadiusKm)
+	switch RadiusUnits(p.RadiusUnits) {
+	case "", RadiusKilometers:
+	case RadiusMiles:
+		max = maxSearchRadiusMi
+	default:
+		return fmt.Errorf("invalid radius_units %q", p.RadiusUnits)
+	}
+	if p.Radius == "" {
+		return nil
+	}
+	r, err := strconv.ParseFloat(p.Radius, 64)
+	if err != nil || !(r > 0 && r <= max) {
+		return fmt.Errorf("radius %q is not greater than 0 and at most %v", p.Radius, max)
+	}
+	return nil
+}
+
+// Builds PhotosSearchParams from typed values, and checks them with Validate.
+// Methods return the builder so calls can be chained:
+//
+//	params, err := flickgo.NewSearch().
+//		Tags(flickgo.TagModeAll, "sunset", "beach").
+//		Near(51.5, -0.12, 5, flickgo.RadiusKilometers).
+//		Sort(flickgo.SortInterestingnessDesc).
+//		Build()
+type SearchBuilder struct {
+	params PhotosSearchParams
+	errs   []error
+}
+
+// Returns a builder for a search with no restrictions.
+func NewSearch() *SearchBuilder {
+	return &SearchBuilder{}
+}
+
+// Formats a coordinate or distance for a search argument.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Searches the photos of the given user, or the calling user's with "me".
+func (b *SearchBuilder) User(userID string) *SearchBuilder {
+	b.params.UserID = userID
+	return b
+}
+
+// Searches photos with the given tags.  Prefix a tag with "-" to exclude it.
+func (b *SearchBuilder) Tags(mode TagMode, tags ...string) *SearchBuilder {
+	for _, t := range tags {
+		if strings.TrimSpace(t) == "" || strings.Contains(t, ",") {
+			b.errs = append(b.errs, fmt.Errorf("invalid tag %q", t))
+		}
+	}
+	b.params.Tags = strings.Join(tags, ",")
+	b.params.TagMode = string(mode)
+	return b
+}
+
+// Searches photos with the given machine tags, e.g. "dc:title=".
+func (b *SearchBuilder) MachineTags(mode TagMode, tags ...string) *SearchBuilder {
+	for _, t := range tags {
+		if strings.TrimSpace(t) == "" || strings.Contains(t, ",") {
+			b.errs = append(b.errs, fmt.Errorf("invalid machine tag %q", t))
+		}
+	}
+	b.params.MachineTags = strings.Join(tags, ",")
+	b.params.MachineTagMode = string(mode)
+	return b
+}
+
+// Searches photos whose title, description or tags contain text.
+func (b *SearchBuilder) Text(text string) *SearchBuilder {
+	b.params.Text = text
+	return b
+}
+
+// Searches photos uploaded between min and max, inclusive.  Zero times leave
+// that end of the range open.
+func (b *SearchBuilder) UploadedBetween(min, max time.Time) *SearchBuilder {
+	b.params.MinUploadDate, b.params.MaxUploadDate = min, max
+	return b
+}
+
+// Searches photos taken between min and max, inclusive.  Zero times leave
+// that end of the range open.
+func (b *SearchBuilder) TakenBetween(min, max time.Time) *SearchBuilder {
+	b.params.MinTakenDate, b.params.MaxTakenDate = min, max
+	return b
+}
+
+// Searches photos with any of the given license IDs.  See
+// flickr.photos.licenses.getInfo for their meaning.
+func (b *SearchBuilder) Licenses(ids ...int) *SearchBuilder {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	b.params.License = strings.Join(s, ",")
+	return b
+}
+
+// Sets the order of results.
+func (b *SearchBuilder) Sort(order SortOrder) *SearchBuilder {
+	b.params.Sort = string(order)
+	return b
+}
+
+// Searches only the calling user's photos with the given privacy level.
+func (b *SearchBuilder) Privacy(filter PrivacyFilter) *SearchBuilder {
+	b.params.PrivacyFilter = int(filter)
+	return b
+}
+
+// Sets the safe search level.  Unauthenticated searches only see safe
+// photos.
+func (b *SearchBuilder) SafeSearch(level SafetyLevel) *SearchBuilder {
+	b.params.SafeSearch = int(level)
+	return b
+}
+
+// Searches only photos of the given content types.
+func (b *SearchBuilder) ContentTypes(types ...ContentType) *SearchBuilder {
+	var photo, screenshot, other bool
+	for _, t := range types {
+		switch t {
+		case ContentPhoto:
+			photo = true
+		case ContentScreenshot:
+			screenshot = true
+		case ContentOther:
+			other = true
+		default:
+			b.errs = append(b.errs, fmt.Errorf("invalid content type %d", t))
+		}
+	}
+	// Flickr numbers the combinations of content types.
+	switch {
+	case photo && screenshot && other:
+		b.params.ContentType = 7
+	case photo && other:
+		b.params.ContentType = 6
+	case screenshot && other:
+		b.params.ContentType = 5
+	case photo && screenshot:
+		b.params.ContentType = 4
+	case other:
+		b.params.ContentType = 3
+	case screenshot:
+		b.params.ContentType = 2
+	case photo:
+		b.params.ContentType = 1
+	default:
+		b.params.ContentType = 0
+	}
+	return b
+}
+
+// Searches only photos or only videos.
+func (b *SearchBuilder) Media(media MediaType) *SearchBuilder {
+	b.params.Media = string(media)
+	return b
+}
+
+// Searches photos in the given group's pool.
+func (b *SearchBuilder) Group(groupID string) *SearchBuilder {
+	b.params.GroupID = groupID
+	return b
+}
+
+// Searches photos within a bounding box.  Geo searches need a limiting agent;
+// see Validate.
+func (b *SearchBuilder) BBox(minLon, minLat, maxLon, maxLat float64) *SearchBuilder {
+	b.params.BBox = strings.Join([]string{formatFloat(minLon), formatFloat(minLat),
+		formatFloat(maxLon), formatFloat(maxLat)}, ",")
+	return b
+}
+
+// Searches photos taken within radius of a point.  Geo searches need a
+// limiting agent; see Validate.
+func (b *SearchBuilder) Near(lat, lon, radius float64, units RadiusUnits) *SearchBuilder {
+	b.params.Lat, b.params.Lon = formatFloat(lat), formatFloat(lon)
+	b.params.Radius, b.params.RadiusUnits = formatFloat(radius), string(units)
+	return b
+}
+
+// Searches photos taken at a Where On Earth ID.
+func (b *SearchBuilder) WoeID(woeID string) *SearchBuilder {
+	b.params.WoeID = woeID
+	return b
+}
+
+// Searches photos taken at a Flickr place.
+func (b *SearchBuilder) Place(placeID string) *SearchBuilder {
+	b.params.PlaceID = placeID
+	return b
+}
+
+// Searches only geotagged photos, or only ones that are not geotagged.
+func (b *SearchBuilder) HasGeo(geotagged bool) *SearchBuilder {
+	b.params.HasGeo = "0"
+	if geotagged {
+		b.params.HasGeo = "1"
+	}
+	return b
+}
+
+// Searches photos with the given geo context.
+func (b *SearchBuilder) GeoContext(gc GeoContext) *SearchBuilder {
+	b.params.GeoContext = strconv.Itoa(int(gc))
+	return b
+}
+
+// Searches photos with at least the given location accuracy, from 1 for
+// world level to 16 for street level.
+func (b *SearchBuilder) Accuracy(accuracy int) *SearchBuilder {
+	b.params.Accuracy = accuracy
+	return b
+}
+
+// Requests extra information for each photo.
+func (b *SearchBuilder) Extras(extras ...Extra) *SearchBuilder {
+	b.params.Extras = Extras(extras).String()
+	return b
+}
+
+// Sets the number of photos per page, at most 500.
+func (b *SearchBuilder) PerPage(n int) *SearchBuilder {
+	if n < 1 {
+		b.errs = append(b.errs, fmt.Errorf("per_page %d is not between 1 and %d", n, maxSearchPerPage))
+	}
+	b.params.PerPage = n
+	return b
+}
+
+// Sets the page of results to return, starting at 1.
+func (b *SearchBuilder) Page(n int) *SearchBuilder {
+	if n < 1 {
+		b.errs = append(b.errs, fmt.Errorf("invalid page %d", n))
+	}
+	b.params.Page = n
+	return b
+}
+
+// Returns the search parameters, or an error describing every problem found
+// with them.
+func (b *SearchBuilder) Build() (PhotosSearchParams, error) {
+	errs := append([]error(nil), b.errs...)
+	if err := b.params.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return PhotosSearchParams{}, wrapErr("invalid search", err)
+	}
+	return b.params, nil
+}
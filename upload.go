@@ -0,0 +1,377 @@
+package flickgo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Called while a file is uploaded with the number of bytes of it sent so far
+// and its total size, which is 0 if unknown.
+type ProgressFunc func(sent int64, total int64)
+
+// A photo or video to upload.
+type UploadFile struct {
+	// File name sent to Flickr.  The content type is detected from the
+	// first bytes of the file; the extension is only a fallback for files
+	// that are not recognised.  See DetectContentType.
+	Name string
+
+	// Contents of the file.  The upload is retried according to
+	// Client.Retry only if Reader is an io.Seeker, in which case it is
+	// rewound to its current offset before each retry.
+	Reader io.Reader
+
+	// Size of the file in bytes, or 0 if unknown.  If set, the request is
+	// sent with a Content-Length and fails if Reader yields a different
+	// number of bytes; otherwise it is sent in chunks.
+	Size int64
+
+	// Optional callback reporting progress of the upload.
+	Progress ProgressFunc
+}
+
+// Safety levels of photos.
+type SafetyLevel int
+
+const (
+	SafetySafe       SafetyLevel = 1
+	SafetyModerate   SafetyLevel = 2
+	SafetyRestricted SafetyLevel = 3
+)
+
+// Content types of photos.
+type ContentType int
+
+const (
+	ContentPhoto      ContentType = 1
+	ContentScreenshot ContentType = 2
+	ContentOther      ContentType = 3
+)
+
+// Visibility of photos in public searches.
+type SearchVisibility int
+
+const (
+	SearchVisible SearchVisibility = 1
+	SearchHidden  SearchVisibility = 2
+)
+
+// Returns a pointer to b, for the privacy fields of UploadParams.
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Metadata sent with an upload.  Zero fields are not sent, and Flickr uses
+// the user's defaults for them.  See
+// https://www.flickr.com/services/api/upload.api.html.
+type UploadParams struct {
+	// The title of the photo.
+	Title string `mapper:"title"`
+
+	// A description of the photo. May contain some limited HTML.
+	Description string `mapper:"description"`
+
+	// Tags to apply to the photo.  Tags may contain spaces but not double
+	// quotes.
+	Tags []string `mapper:"tags"`
+
+	// Who may see the photo.  Use Bool to set these; nil leaves the choice
+	// to the user's default privacy setting.
+	IsPublic *bool `mapper:"is_public"`
+	IsFriend *bool `mapper:"is_friend"`
+	IsFamily *bool `mapper:"is_family"`
+
+	// One of SafetySafe, SafetyModerate or SafetyRestricted.
+	SafetyLevel SafetyLevel `mapper:"safety_level"`
+
+	// One of ContentPhoto, ContentScreenshot or ContentOther.
+	ContentType ContentType `mapper:"content_type"`
+
+	// Whether the photo appears in public searches: SearchVisible or
+	// SearchHidden.
+	Hidden SearchVisibility `mapper:"hidden"`
+}
+
+// Reports an error if any of p's fields has a value Flickr does not accept.
+func (p *UploadParams) Validate() error {
+	if p.SafetyLevel != 0 && (p.SafetyLevel < SafetySafe || p.SafetyLevel > SafetyRestricted) {
+		return fmt.Errorf("invalid safety level %d", p.SafetyLevel)
+	}
+	if p.ContentType != 0 && (p.ContentType < ContentPhoto || p.ContentType > ContentOther) {
+		return fmt.Errorf("invalid content type %d", p.ContentType)
+	}
+	if p.Hidden != 0 && p.Hidden != SearchVisible && p.Hidden != SearchHidden {
+		return fmt.Errorf("invalid search visibility %d", p.Hidden)
+	}
+	for _, t := range p.Tags {
+		if strings.TrimSpace(t) == "" || strings.Contains(t, `"`) {
+			return fmt.Errorf("invalid tag %q", t)
+		}
+	}
+	return nil
+}
+
+// Returns the upload arguments for p.
+func (p *UploadParams) args() (map[string]string, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	a := StructToMap(p)
+	if len(p.Tags) > 0 {
+		tags := make([]string, len(p.Tags))
+		for i, t := range p.Tags {
+			if strings.ContainsAny(t, " \t") {
+				t = `"` + t + `"`
+			}
+			tags[i] = t
+		}
+		a["tags"] = strings.Join(tags, " ")
+	}
+	return a, nil
+}
+
+// Copied from mime/multipart/writer.go.
+func escapeQuotes(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return s
+}
+
+// Writes a multipart form with the given fields and the photo read from
+// photo to w.  boundary separates the parts, and contentType is the content
+// type of the photo.
+func multipartWriter(w io.Writer, boundary string, filename string, contentType string,
+	photo io.Reader, args map[string]string) (*multipart.Writer, error) {
+	mpw := multipart.NewWriter(w)
+	if err := mpw.SetBoundary(boundary); err != nil {
+		return nil, wrapErr("invalid boundary", err)
+	}
+	for k, v := range args {
+		if err := mpw.WriteField(k, v); err != nil {
+			return nil, wrapErr(fmt.Sprintf("field write failed [%v=%v]", k, v), err)
+		}
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition",
+		fmt.Sprintf(`form-data; name="photo"; filename="%s"`,
+			escapeQuotes(filename)))
+	h.Set("Content-Type", contentType)
+	pw, cErr := mpw.CreatePart(h)
+	if cErr != nil {
+		return nil, wrapErr("form file creation failed ["+filename+"]", cErr)
+	}
+	if _, err := io.Copy(pw, photo); err != nil {
+		return nil, wrapErr("adding photo data failed", err)
+	}
+	if err := mpw.Close(); err != nil {
+		return nil, wrapErr("multipart close failed", err)
+	}
+	return mpw, nil
+}
+
+// Writer that counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// Reader that reports the bytes read through it to a ProgressFunc.  If total
+// is set, reading fails unless r yields exactly total bytes.
+type progressReader struct {
+	r        io.Reader
+	name     string
+	sent     int64
+	total    int64
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.sent += int64(n)
+		if r.progress != nil {
+			r.progress(r.sent, r.total)
+		}
+	}
+	if r.total > 0 && (r.sent > r.total || (err == io.EOF && r.sent != r.total)) {
+		return n, fmt.Errorf("%s: read %d bytes, expected %d", r.name, r.sent, r.total)
+	}
+	return n, err
+}
+
+// Multipart form for uploading a file.
+type uploadForm struct {
+	url         string
+	boundary    string
+	params      map[string]string
+	file        UploadFile
+	contentType string
+
+	// params signed for the last request.
+	args map[string]string
+
+	// Offset of the file in file.Reader, for rewinding it.
+	start int64
+
+	// The last body returned by body.
+	last *formBody
+}
+
+// Returns the length of the form in bytes, or -1 if unknown.
+func (f *uploadForm) length() int64 {
+	if f.file.Size <= 0 {
+		return -1
+	}
+	var n countingWriter
+	if _, err := multipartWriter(&n, f.boundary, f.file.Name, f.contentType, strings.NewReader(""), f.args); err != nil {
+		return -1
+	}
+	return int64(n) + f.file.Size
+}
+
+// Writes the form to w.
+func (f *uploadForm) write(w io.Writer) error {
+	pr := &progressReader{
+		r:        f.file.Reader,
+		name:     f.file.Name,
+		total:    f.file.Size,
+		progress: f.file.Progress,
+	}
+	_, err := multipartWriter(w, f.boundary, f.file.Name, f.contentType, pr, f.args)
+	return err
+}
+
+// Body of an upload request.  The form is written through a pipe once the
+// body is first read, so the file is never held in memory.
+type formBody struct {
+	pr    *io.PipeReader
+	pw    *io.PipeWriter
+	write func(io.Writer) error
+	once  sync.Once
+
+	// Closed once the writer has stopped.
+	done chan struct{}
+}
+
+func (b *formBody) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		go func() {
+			defer close(b.done)
+			b.pw.CloseWithError(b.write(b.pw))
+		}()
+	})
+	return b.pr.Read(p)
+}
+
+func (b *formBody) Close() error {
+	return b.pr.Close()
+}
+
+// Closes b and waits until its writer has stopped reading the file.
+func (b *formBody) stop() {
+	b.pr.Close()
+	b.once.Do(func() { close(b.done) })
+	<-b.done
+}
+
+// Returns a reader for the form.  Every call after the first rewinds the
+// file, which must be an io.Seeker.
+func (f *uploadForm) body() (io.ReadCloser, error) {
+	if f.last != nil {
+		f.last.stop()
+		if _, err := f.file.Reader.(io.Seeker).Seek(f.start, io.SeekStart); err != nil {
+			return nil, wrapErr("rewinding file failed", err)
+		}
+	}
+	pr, pw := io.Pipe()
+	f.last = &formBody{pr: pr, pw: pw, write: f.write, done: make(chan struct{})}
+	return f.last, nil
+}
+
+// Returns the form uploading file to the upload or replace endpoint u.
+// async selects asynchronous processing, for which Flickr returns a ticket ID
+// rather than the photo ID.  Files in formats Flickr does not accept are
+// rejected.
+func newUploadForm(c *Client, u string, file UploadFile, args map[string]string,
+	async bool) (*uploadForm, error) {
+	file, ct, sErr := sniffFile(file)
+	if sErr != nil {
+		return nil, sErr
+	}
+	f := &uploadForm{
+		url:         u,
+		boundary:    multipart.NewWriter(nil).Boundary(),
+		params:      clone(args),
+		file:        file,
+		contentType: ct,
+	}
+	f.params["api_key"] = c.apiKey
+	if async {
+		f.params["async"] = "1"
+	}
+	if s, ok := file.Reader.(io.Seeker); ok {
+		start, err := s.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, wrapErr("seeking file failed", err)
+		}
+		f.start = start
+	}
+	return f, nil
+}
+
+// Reports whether the form can be sent more than once.
+func (f *uploadForm) replayable() bool {
+	_, ok := f.file.Reader.(io.Seeker)
+	return ok
+}
+
+// Returns a POST request sending the form, signed with a fresh nonce and
+// timestamp.  Every call after the first rewinds the file, which must be an
+// io.Seeker.
+func (f *uploadForm) request(c *Client) (*http.Request, error) {
+	body, bErr := f.body()
+	if bErr != nil {
+		return nil, bErr
+	}
+	// Signed only now that body has stopped the writer of the last request.
+	f.args = oauthArgs(c, "POST", f.url, f.params, c.creds.Token, c.creds.Secret)
+	req, rErr := http.NewRequest("POST", f.url, body)
+	if rErr != nil {
+		body.Close()
+		return nil, wrapErr("request creation failed", rErr)
+	}
+	req.ContentLength = f.length()
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+f.boundary)
+	return req, nil
+}
+
+// Returns an UploadFile reading from photo.
+func bytesFile(name string, photo []byte) UploadFile {
+	return UploadFile{Name: name, Reader: bytes.NewReader(photo), Size: int64(len(photo))}
+}
+
+// Sends file to the upload or replace endpoint u and populates resp from the
+// response.  method is "upload" or "replace".
+func postUpload(ctx context.Context, c *Client, method string, u string, file UploadFile,
+	args map[string]string, async bool, resp interface{}) error {
+	f, fErr := newUploadForm(c, u, file, args, async)
+	if fErr != nil {
+		return wrapErr("request creation failed", fErr)
+	}
+	// The upload API always responds in XML.
+	if err := flickrPost(ctx, c, method, f.replayable(), func() (*http.Request, error) {
+		return f.request(c)
+	}, FormatXML, resp); err != nil {
+		return wrapErr(method+" failed", err)
+	}
+	return nil
+}